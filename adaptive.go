@@ -0,0 +1,130 @@
+package main
+
+// Back off collecting smart-log from drives whose values don't change, so
+// idle drives aren't woken up on every scrape
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type adaptiveDevice struct {
+	lastCollect time.Time
+	interval    time.Duration
+	values      string
+	metrics     []prometheus.Metric
+	summary     smartLogSummary
+}
+
+// adaptiveSampler doubles the interval between smart-log collections of a
+// device each time its values are unchanged, up to maxInterval, and goes
+// back to collecting every scrape as soon as they change. Scrapes within
+// the interval are served the metrics of the last collection.
+type adaptiveSampler struct {
+	maxInterval              time.Duration
+	nvmeDeviceScrapeInterval *prometheus.Desc
+	mu                       sync.Mutex
+	devices                  map[string]*adaptiveDevice
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+func newAdaptiveSampler(maxInterval time.Duration) *adaptiveSampler {
+	return &adaptiveSampler{
+		maxInterval: maxInterval,
+		nvmeDeviceScrapeInterval: prometheus.NewDesc(
+			metricName("device_scrape_interval_seconds"),
+			"Current interval between smart-log collections of the device, 0 when collected on every scrape",
+			labels,
+			nil,
+		),
+		devices: make(map[string]*adaptiveDevice),
+		now:     time.Now,
+	}
+}
+
+func (s *adaptiveSampler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.nvmeDeviceScrapeInterval
+}
+
+// collect runs collectSmartLog for the device if its interval has passed,
+// otherwise replays the metrics of the last collection. It returns the
+// summary of the collection like collectSmartLog, failed collections aren't
+// replayed. label is the device label of the smart-log metrics.
+func (s *adaptiveSampler) collect(ch chan<- prometheus.Metric, nvmeDevice string, label string, collectSmartLog func(chan<- prometheus.Metric) (smartLogSummary, error)) (smartLogSummary, error) {
+	now := s.now()
+	s.mu.Lock()
+	device, ok := s.devices[nvmeDevice]
+	if ok && now.Sub(device.lastCollect) < device.interval {
+		metrics, summary, interval, lastCollect := device.metrics, device.summary, device.interval, device.lastCollect
+		s.mu.Unlock()
+		debugf("Serving smart-log of device %s collected %s ago\n", nvmeDevice, now.Sub(lastCollect))
+		for _, m := range metrics {
+			ch <- m
+		}
+		ch <- prometheus.MustNewConstMetric(s.nvmeDeviceScrapeInterval, prometheus.GaugeValue, interval.Seconds(), label)
+		return summary, nil
+	}
+	s.mu.Unlock()
+
+	// record the metrics while passing them on
+	var metrics []prometheus.Metric
+	out := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range out {
+			metrics = append(metrics, m)
+			ch <- m
+		}
+		close(done)
+	}()
+	summary, err := collectSmartLog(out)
+	close(out)
+	<-done
+	if err != nil {
+		return summary, err
+	}
+	values := metricValues(metrics)
+
+	s.mu.Lock()
+	if !ok {
+		device = &adaptiveDevice{}
+		s.devices[nvmeDevice] = device
+	}
+	switch {
+	case !ok || values != device.values:
+		device.interval = 0
+	case device.interval == 0:
+		device.interval = now.Sub(device.lastCollect)
+	default:
+		device.interval *= 2
+	}
+	if device.interval > s.maxInterval {
+		device.interval = s.maxInterval
+	}
+	device.lastCollect = now
+	device.values = values
+	device.metrics = metrics
+	device.summary = summary
+	interval := device.interval
+	s.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(s.nvmeDeviceScrapeInterval, prometheus.GaugeValue, interval.Seconds(), label)
+	return summary, nil
+}
+
+// metricValues serializes metrics so collections can be compared
+func metricValues(metrics []prometheus.Metric) string {
+	var values []string
+	for _, m := range metrics {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		values = append(values, m.Desc().String()+metric.String())
+	}
+	return strings.Join(values, "\n")
+}
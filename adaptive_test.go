@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAdaptiveSamplerInterval(t *testing.T) {
+	desc := prometheus.NewDesc("nvme_test_value", "Test value", labels, nil)
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		elapsed   time.Duration
+		value     float64
+		collected bool
+		interval  time.Duration
+	}{
+		// the first collection and every changed value collect every scrape
+		{0, 1, true, 0},
+		// unchanged values back off to the time since the last collection
+		{10 * time.Second, 1, true, 10 * time.Second},
+		// scrapes within the interval replay the last collection
+		{15 * time.Second, 2, false, 10 * time.Second},
+		// and then the interval doubles, up to the maximum
+		{20 * time.Second, 1, true, 20 * time.Second},
+		{40 * time.Second, 1, true, 30 * time.Second},
+		{70 * time.Second, 2, true, 0},
+	}
+	sampler := newAdaptiveSampler(30 * time.Second)
+	for _, test := range tests {
+		sampler.now = func() time.Time { return start.Add(test.elapsed) }
+		collected := false
+		ch := make(chan prometheus.Metric, 10)
+		_, err := sampler.collect(ch, "/dev/nvme0n1", "nvme0", func(ch chan<- prometheus.Metric) (smartLogSummary, error) {
+			collected = true
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, test.value, "/dev/nvme0n1")
+			return smartLogSummary{}, nil
+		})
+		close(ch)
+		if err != nil {
+			t.Fatalf("after %s: unexpected error: %s", test.elapsed, err)
+		}
+		if collected != test.collected {
+			t.Errorf("after %s: collected = %v, want %v", test.elapsed, collected, test.collected)
+		}
+		var interval *dto.Metric
+		for m := range ch {
+			if m.Desc() == sampler.nvmeDeviceScrapeInterval {
+				interval = &dto.Metric{}
+				if err := m.Write(interval); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if interval == nil {
+			t.Errorf("after %s: nvme_device_scrape_interval_seconds is missing", test.elapsed)
+			continue
+		}
+		if got := interval.GetGauge().GetValue(); got != test.interval.Seconds() {
+			t.Errorf("after %s: interval = %v, want %v", test.elapsed, got, test.interval.Seconds())
+		}
+		// the interval is labeled like the other smart-log metrics
+		if got := interval.GetLabel()[0].GetValue(); got != "nvme0" {
+			t.Errorf("after %s: interval labeled %q, want nvme0", test.elapsed, got)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+// Load friendly device names exported on nvme_device_info
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadDeviceAliases reads a json object mapping device paths to aliases,
+// e.g. {"/dev/nvme3n1": "data-vol-a"}
+func loadDeviceAliases(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var aliases map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return aliases, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	if err := ioutil.WriteFile(path, []byte(`{"/dev/nvme0n1": "data-vol-a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := loadDeviceAliases(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testTwoDriveNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	config.deviceAliases = aliases
+	families := gatherMetrics(t, newNvmeCollector(config))
+	if _, ok := metricValue(families, "nvme_device_info", "device", "/dev/nvme0n1", "alias", "data-vol-a"); !ok {
+		t.Errorf("nvme_device_info of /dev/nvme0n1 isn't labeled with its alias")
+	}
+	// devices without an alias get an empty alias
+	if _, ok := metricValue(families, "nvme_device_info", "device", "/dev/nvme1n1", "alias", ""); !ok {
+		t.Errorf("nvme_device_info of /dev/nvme1n1 has an alias without one in the file")
+	}
+	// the alias is only on nvme_device_info
+	for _, metric := range families["nvme_temperature"].GetMetric() {
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == "alias" {
+				t.Errorf("nvme_temperature is labeled with the alias")
+			}
+		}
+	}
+}
+
+func TestLoadDeviceAliasesInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	if err := ioutil.WriteFile(path, []byte(`["/dev/nvme0n1"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDeviceAliases(path); err == nil {
+		t.Errorf("expected an error loading an alias file that isn't an object")
+	}
+	if _, err := loadDeviceAliases(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("expected an error loading a missing alias file")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+// Availability markers for smart-log values missing from a drive's output
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// availabilityMarkers maps each smart-log metric to a companion
+// nvme_<metric>_available gauge, so dashboards can tell a value the drive
+// didn't report apart from a real 0
+type availabilityMarkers struct {
+	descs map[*prometheus.Desc]*prometheus.Desc
+}
+
+func newAvailabilityMarkers(descs ...*prometheus.Desc) *availabilityMarkers {
+	m := &availabilityMarkers{descs: make(map[*prometheus.Desc]*prometheus.Desc)}
+	for _, desc := range descs {
+		name := descNameRegexp.FindStringSubmatch(desc.String())
+		if name == nil {
+			continue
+		}
+		m.descs[desc] = prometheus.NewDesc(
+			name[1]+"_available",
+			"Whether "+name[1]+" was reported by the device, 0 when the value is missing",
+			labels,
+			nil,
+		)
+	}
+	return m
+}
+
+func (m *availabilityMarkers) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range m.descs {
+		ch <- desc
+	}
+}
+
+// mark emits the availability of the value of desc for the device
+func (m *availabilityMarkers) mark(ch chan<- prometheus.Metric, desc *prometheus.Desc, available bool, label string) {
+	marker, ok := m.descs[desc]
+	if !ok {
+		return
+	}
+	value := 0.0
+	if available {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(marker, prometheus.GaugeValue, value, label)
+}
+
+// smartLogValue emits a smart-log value, see smartLogFloat
+func (c *nvmeCollector) smartLogValue(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, result gjson.Result, label string) {
+	c.smartLogFloat(ch, desc, valueType, result.Float(), result.Exists(), label)
+}
+
+// smartLogFloat emits value for a smart-log metric. Without --always-emit
+// missing values are reported as the 0 passed in like before. With it every
+// metric is emitted along with its availability marker, and missing values
+// are NaN rather than a 0 the drive never reported.
+func (c *nvmeCollector) smartLogFloat(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, value float64, available bool, label string) {
+	if c.availability != nil {
+		c.availability.mark(ch, desc, available, label)
+		if !available {
+			value = math.NaN()
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(desc, valueType, value, label)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAvailabilityMarkers(t *testing.T) {
+	useTestSysfs(t)
+	// testSmartLog leaves out power_cycles and unsafe_shutdowns, and reports
+	// media_errors as 0
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	config := testCollectorConfig(runner)
+	config.alwaysEmit = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	tests := []struct {
+		name      string
+		available float64
+	}{
+		{"nvme_media_errors", 1},
+		{"nvme_avail_spare", 1},
+		{"nvme_critical_warning", 1},
+		{"nvme_reliability_degraded", 1},
+		{"nvme_power_cycles", 0},
+		{"nvme_unsafe_shutdowns", 0},
+	}
+	for _, test := range tests {
+		if got, ok := metricValue(families, test.name+"_available", "device", "/dev/nvme0n1"); !ok || got != test.available {
+			t.Errorf("%s_available = %v, %v, want %v", test.name, got, ok, test.available)
+		}
+		// missing values are kept as NaN instead of a 0 the drive didn't report
+		got, ok := metricValue(families, test.name, "device", "/dev/nvme0n1")
+		if !ok {
+			t.Errorf("%s is missing", test.name)
+		} else if missing := test.available == 0; math.IsNaN(got) != missing {
+			t.Errorf("%s = %v, want NaN only when missing", test.name, got)
+		}
+	}
+	if got, _ := metricValue(families, "nvme_media_errors", "device", "/dev/nvme0n1"); got != 0 {
+		t.Errorf("nvme_media_errors = %v, want the reported 0", got)
+	}
+
+	// without always-emit missing values are reported as 0
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if got, ok := metricValue(families, "nvme_power_cycles", "device", "/dev/nvme0n1"); !ok || got != 0 {
+		t.Errorf("nvme_power_cycles = %v, %v without always-emit, want 0", got, ok)
+	}
+	if _, ok := families["nvme_power_cycles_available"]; ok {
+		t.Errorf("nvme_power_cycles_available exported without always-emit")
+	}
+}
+
+func TestAvailabilityMarkersCriticalWarning(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":    testNvmeList,
+		"id-ctrl": testIdCtrl,
+		// a partial log without critical_warning or temperature
+		"smart-log": `{"avail_spare": 100, "data_units_read": 1000}`,
+	})
+	config.alwaysEmit = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	for _, name := range []string{
+		"nvme_critical_warning",
+		"nvme_avail_spare_below_threshold",
+		"nvme_temp_threshold_exceeded",
+		"nvme_reliability_degraded",
+		"nvme_readonly",
+		"nvme_vmbu_failed",
+		"nvme_pmr_readonly",
+		"nvme_temperature",
+		"nvme_data_written_bytes_total",
+	} {
+		if got, ok := metricValue(families, name+"_available", "device", "/dev/nvme0n1"); !ok || got != 0 {
+			t.Errorf("%s_available = %v, %v, want 0", name, got, ok)
+		}
+		if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || !math.IsNaN(got) {
+			t.Errorf("%s = %v, %v for a missing field, want NaN", name, got, ok)
+		}
+	}
+	if got, ok := metricValue(families, "nvme_data_read_bytes_total_available", "device", "/dev/nvme0n1"); !ok || got != 1 {
+		t.Errorf("nvme_data_read_bytes_total_available = %v, %v, want 1", got, ok)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+// Serve the metrics of the last collection for --cache-ttl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectCache replays the metrics of the last collection while they are
+// younger than ttl, so frequent scrapes don't run the nvme admin commands
+// again. Concurrent scrapes wait for the collection in progress.
+type collectCache struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	lastCollect time.Time
+	metrics     []prometheus.Metric
+}
+
+func newCollectCache(ttl time.Duration) *collectCache {
+	return &collectCache{ttl: ttl}
+}
+
+func (cache *collectCache) collect(ch chan<- prometheus.Metric, collect func(chan<- prometheus.Metric)) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.lastCollect.IsZero() && time.Since(cache.lastCollect) < cache.ttl {
+		debugf("Serving nvme metrics collected %s ago\n", time.Since(cache.lastCollect))
+		for _, m := range cache.metrics {
+			ch <- m
+		}
+		return
+	}
+	// record the metrics while passing them on
+	var metrics []prometheus.Metric
+	out := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range out {
+			metrics = append(metrics, m)
+			ch <- m
+		}
+		close(done)
+	}()
+	collect(out)
+	close(out)
+	<-done
+	cache.metrics = metrics
+	cache.lastCollect = time.Now()
+}
@@ -0,0 +1,150 @@
+package main
+
+// Export per-controller metrics from nvme id-ctrl
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// collectController returns the parsed id-ctrl output so namespace metrics
+// can use controller fields, or false if id-ctrl failed. devices are the
+// collected namespaces of the controller.
+func (c *nvmeCollector) collectController(ch chan<- prometheus.Metric, controller nvmeController, devices []string) (gjson.Result, bool) {
+	controllerDevice := "/dev/" + controller.Name
+	nvmeIdCtrl, err := runNvmeJSON(c.runner, "id-ctrl", controllerDevice, "-o", "json")
+	if err != nil {
+		warnf("Error running nvme id-ctrl command for controller %s: %s\n", controller.Name, err)
+		return gjson.Result{}, false
+	}
+	if !gjson.ValidBytes(nvmeIdCtrl) {
+		warnf("nvmeIdCtrl json is not valid for controller: %s\n", controller.Name)
+		return gjson.Result{}, false
+	}
+	idCtrl := gjson.ParseBytes(nvmeIdCtrl)
+	// capacity is reported for every controller, including those without namespaces
+	ch <- prometheus.MustNewConstMetric(c.nvmeTotalCapacity, prometheus.GaugeValue, idCtrl.Get("tnvmcap").Float(), controller.Name)
+	activateNoReset, slots := parseFirmwareUpdates(idCtrl.Get("frmw"))
+	ch <- prometheus.MustNewConstMetric(c.nvmeFirmwareActivateNoReset, prometheus.GaugeValue, activateNoReset, controller.Name)
+	ch <- prometheus.MustNewConstMetric(c.nvmeFirmwareSlots, prometheus.GaugeValue, slots, controller.Name)
+	ch <- prometheus.MustNewConstMetric(c.nvmeRtd3EntryLatency, prometheus.GaugeValue, idCtrl.Get("rtd3e").Float(), controller.Name)
+	ch <- prometheus.MustNewConstMetric(c.nvmeRtd3ExitLatency, prometheus.GaugeValue, idCtrl.Get("rtd3r").Float(), controller.Name)
+	// elpe is a 0's based count of error log page entries
+	errorLogCapacity := idCtrl.Get("elpe").Float() + 1
+	ch <- prometheus.MustNewConstMetric(c.nvmeErrorLogCapacity, prometheus.GaugeValue, errorLogCapacity, controller.Name)
+	if c.errorLog != nil {
+		c.errorLog.collect(ch, controller.Name, errorLogCapacity)
+	}
+	if c.firmwareLog != nil {
+		c.firmwareLog.collect(ch, controller.Name)
+	}
+	// endgidmax is 0 for controllers without endurance groups
+	if c.endurance != nil && idCtrl.Get("endgidmax").Uint() != 0 {
+		c.endurance.collect(ch, controller.Name, devices)
+	}
+	if c.nvmePowerStateMaxPower != nil {
+		for i, psd := range idCtrl.Get("psds").Array() {
+			ch <- prometheus.MustNewConstMetric(c.nvmePowerStateMaxPower, prometheus.GaugeValue, powerStateMaxPower(psd), controller.Name, strconv.Itoa(i))
+		}
+	}
+	if c.collectQueues {
+		c.collectNumberOfQueues(ch, controller.Name)
+	}
+	// vwc bit 0 is set when a volatile write cache is present
+	if c.collectVolatileWriteCache && idCtrl.Get("vwc").Uint()&1 == 1 {
+		c.collectWriteCache(ch, controller.Name)
+	}
+	// hmpre is the preferred host memory buffer size, 0 without support
+	if c.collectHostMemoryBuffer && idCtrl.Get("hmpre").Uint() != 0 {
+		c.collectHMB(ch, controller.Name)
+	}
+	return idCtrl, true
+}
+
+func (c *nvmeCollector) collectHMB(ch chan<- prometheus.Metric, controller string) {
+	output, err := getFeatureOutput(c.runner, "/dev/"+controller, 0x0d, featureSelectCurrent, "-H")
+	if err != nil {
+		c.featureUnsupported("host memory buffer", controller, err)
+		return
+	}
+	enabled, size, err := parseHostMemoryBuffer(output)
+	if err != nil {
+		warnf("Skipping host memory buffer for controller %s: %s\n", controller, err)
+		return
+	}
+	hmbEnabled := 0.0
+	if enabled {
+		hmbEnabled = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeHmbEnabled, prometheus.GaugeValue, hmbEnabled, controller)
+	ch <- prometheus.MustNewConstMetric(c.nvmeHmbSize, prometheus.GaugeValue, size, controller)
+}
+
+func (c *nvmeCollector) collectWriteCache(ch chan<- prometheus.Metric, controller string) {
+	value, err := getFeature(c.runner, "/dev/"+controller, 0x06, featureSelectCurrent)
+	if err != nil {
+		c.featureUnsupported("volatile write cache", controller, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeVolatileWriteCacheEnabled, prometheus.GaugeValue, float64(value&1), controller)
+}
+
+// powerStateMaxPower converts the max power of a power state descriptor to
+// watts. mp is in units of 0.01 W, or 0.0001 W when the max power scale
+// (mxps, bit 0 of flags) is set.
+func powerStateMaxPower(psd gjson.Result) float64 {
+	// newer nvme-cli releases decode the flags
+	mxps := psd.Get("flags").Uint() & 1
+	if scale := psd.Get("max_power_scale"); scale.Exists() {
+		mxps = scale.Uint()
+	}
+	if mxps == 1 {
+		return psd.Get("max_power").Float() / 10000
+	}
+	return psd.Get("max_power").Float() / 100
+}
+
+// collectNumberOfQueues exports the number of I/O queues. id-ctrl has no
+// queue count, the default value of the Number of Queues feature, selected
+// with -s 1, is what the controller allocates at most.
+func (c *nvmeCollector) collectNumberOfQueues(ch chan<- prometheus.Metric, controller string) {
+	for _, q := range []struct {
+		desc    *prometheus.Desc
+		sel     int
+		feature string
+	}{
+		{c.nvmeMaxIOQueues, featureSelectDefault, "default number of queues"},
+		{c.nvmeCurrentIOQueues, featureSelectCurrent, "current number of queues"},
+	} {
+		value, err := getFeature(c.runner, "/dev/"+controller, 0x07, q.sel)
+		if err != nil {
+			c.featureUnsupported(q.feature, controller, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(q.desc, prometheus.GaugeValue, parseNumberOfQueues(value), controller)
+	}
+}
+
+// featureUnsupported logs that a controller doesn't support a feature the
+// first time get-feature fails for it, and only at debug level afterwards,
+// so drives without the feature don't log on every scrape
+func (c *nvmeCollector) featureUnsupported(feature string, controller string, err error) {
+	c.mu.Lock()
+	logged := c.unsupportedFeatures[feature+" "+controller]
+	c.unsupportedFeatures[feature+" "+controller] = true
+	c.mu.Unlock()
+	if logged {
+		debugf("Skipping %s for controller %s: %s\n", feature, controller, err)
+		return
+	}
+	warnf("Skipping %s for controller %s, unsupported: %s\n", feature, controller, err)
+}
+
+// parseFirmwareUpdates decodes the frmw (firmware updates) field of id-ctrl
+// into the activation without reset bit and the number of firmware slots.
+func parseFirmwareUpdates(frmw gjson.Result) (float64, float64) {
+	value := frmw.Uint()
+	return float64(value >> 4 & 1), float64(value >> 1 & 7)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseFirmwareUpdates(t *testing.T) {
+	tests := []struct {
+		frmw            string
+		activateNoReset float64
+		slots           float64
+	}{
+		// slot 1 read only, 1 slot
+		{"3", 0, 1},
+		// 7 slots
+		{"14", 0, 7},
+		// activation without reset and 4 slots
+		{"24", 1, 4},
+		{"23", 1, 3},
+		{"0", 0, 0},
+	}
+	for _, test := range tests {
+		activateNoReset, slots := parseFirmwareUpdates(gjson.Parse(test.frmw))
+		if activateNoReset != test.activateNoReset || slots != test.slots {
+			t.Errorf("parseFirmwareUpdates(%s) = %v, %v, want %v, %v", test.frmw, activateNoReset, slots, test.activateNoReset, test.slots)
+		}
+	}
+}
+
+func TestControllerRtd3Latencies(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   `{"sn": "S123", "rtd3e": 8000000, "rtd3r": 500000, "frmw": 23}`,
+		"smart-log": testSmartLog,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	tests := map[string]float64{
+		"nvme_rtd3_entry_latency_us":      8000000,
+		"nvme_rtd3_exit_latency_us":       500000,
+		"nvme_firmware_activate_no_reset": 1,
+		"nvme_firmware_slots":             3,
+	}
+	for name, want := range tests {
+		if got, ok := metricValue(families, name, "controller", "nvme0"); !ok || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, ok, want)
+		}
+	}
+	// controllers that don't report the latencies export 0
+	runner["id-ctrl"] = testIdCtrl
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	for _, name := range []string{"nvme_rtd3_entry_latency_us", "nvme_rtd3_exit_latency_us"} {
+		if got, ok := metricValue(families, name, "controller", "nvme0"); !ok || got != 0 {
+			t.Errorf("%s = %v, %v without rtd3 in id-ctrl, want 0", name, got, ok)
+		}
+	}
+}
+
+func TestIdCtrlLeadingNoise(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   "warning: unable to read /sys/class/nvme/nvme0/hmb\n{\"sn\": \"S123\", \"tnvmcap\": 1920383410176}\n",
+		"smart-log": testSmartLog,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if got, ok := metricValue(families, "nvme_total_capacity", "controller", "nvme0"); !ok || got != 1920383410176 {
+		t.Errorf("nvme_total_capacity = %v, %v after a warning line, want 1920383410176", got, ok)
+	}
+	// output without json soft-fails the controller
+	runner["id-ctrl"] = "warning: unable to read /sys/class/nvme/nvme0/hmb\n"
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_total_capacity"]; ok {
+		t.Errorf("nvme_total_capacity exported without id-ctrl json")
+	}
+}
+
+func TestPowerStateMaxPower(t *testing.T) {
+	tests := []struct {
+		psd  string
+		want float64
+	}{
+		// centiwatts
+		{`{"max_power": 2500, "flags": 0}`, 25},
+		// max power scale set, in units of 0.0001 W
+		{`{"max_power": 2500, "flags": 1}`, 0.25},
+		// only bit 0 of flags is the scale
+		{`{"max_power": 900, "flags": 2}`, 9},
+		// newer nvme-cli releases decode the scale
+		{`{"max_power": 2500, "max_power_scale": 1, "flags": 0}`, 0.25},
+		{`{"max_power": 2500, "max_power_scale": 0, "flags": 1}`, 25},
+	}
+	for _, test := range tests {
+		if got := powerStateMaxPower(gjson.Parse(test.psd)); got != test.want {
+			t.Errorf("powerStateMaxPower(%s) = %v, want %v", test.psd, got, test.want)
+		}
+	}
+}
+
+func TestCollectPowerStates(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   `{"sn": "S123", "psds": [{"max_power": 2500, "flags": 0}, {"max_power": 1200, "flags": 0}, {"max_power": 50, "flags": 1}]}`,
+		"smart-log": testSmartLog,
+	}
+	config := testCollectorConfig(runner)
+	config.collectPowerStates = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	for state, want := range map[string]float64{"0": 25, "1": 12, "2": 0.005} {
+		if got, ok := metricValue(families, "nvme_power_state_max_power_watts", "controller", "nvme0", "state", state); !ok || got != want {
+			t.Errorf("nvme_power_state_max_power_watts{state=%q} = %v, %v, want %v", state, got, ok, want)
+		}
+	}
+	// off by default
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_power_state_max_power_watts"]; ok {
+		t.Errorf("nvme_power_state_max_power_watts exported without collect-power-states")
+	}
+}
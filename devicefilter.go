@@ -0,0 +1,86 @@
+package main
+
+// Select the devices collected with --include-devices and --exclude-devices
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// deviceFilter matches namespace device paths against the include and
+// exclude regexes, exclude takes precedence when both match
+type deviceFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newDeviceFilter parses comma separated regexes, anchored to match the
+// whole device path like --metric-exclude
+func newDeviceFilter(include string, exclude string) (*deviceFilter, error) {
+	var f deviceFilter
+	var err error
+	if f.include, err = compileDeviceRegexps(include); err != nil {
+		return nil, fmt.Errorf("include-devices: %s", err)
+	}
+	if f.exclude, err = compileDeviceRegexps(exclude); err != nil {
+		return nil, fmt.Errorf("exclude-devices: %s", err)
+	}
+	return &f, nil
+}
+
+func compileDeviceRegexps(exprs string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, expr := range strings.Split(exprs, ",") {
+		expr = strings.TrimSpace(expr)
+		if expr == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func matchAny(regexps []*regexp.Regexp, devicePath string) bool {
+	for _, re := range regexps {
+		if re.MatchString(devicePath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *deviceFilter) matches(devicePath string) bool {
+	if matchAny(f.exclude, devicePath) {
+		return false
+	}
+	return len(f.include) == 0 || matchAny(f.include, devicePath)
+}
+
+// filter drops the namespaces that don't match, and the controllers all of
+// whose namespaces were dropped so id-ctrl isn't run for them either
+func (f *deviceFilter) filter(namespaces []nvmeNamespace, controllers []nvmeController) ([]nvmeNamespace, []nvmeController) {
+	var keptNamespaces []nvmeNamespace
+	listed := make(map[string]bool)
+	matchedControllers := make(map[string]bool)
+	for _, namespace := range namespaces {
+		listed[namespace.Controller] = true
+		if f.matches(namespace.DevicePath) {
+			keptNamespaces = append(keptNamespaces, namespace)
+			matchedControllers[namespace.Controller] = true
+		} else {
+			debugf("Skipping device %s, filtered by include-devices or exclude-devices\n", namespace.DevicePath)
+		}
+	}
+	var keptControllers []nvmeController
+	for _, controller := range controllers {
+		if !listed[controller.Name] || matchedControllers[controller.Name] {
+			keptControllers = append(keptControllers, controller)
+		}
+	}
+	return keptNamespaces, keptControllers
+}
@@ -0,0 +1,472 @@
+package main
+
+// Enumerate nvme controllers and namespaces from nvme list output
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// well-known NQN used by NVMe-oF discovery subsystems
+const discoveryNQN = "nqn.2014-08.org.nvmexpress.discovery"
+
+var sysClassNvme = "/sys/class/nvme"
+
+// statDevice checks that a device node exists, unlike sysfs /dev can't be
+// pointed elsewhere in tests
+var statDevice = os.Stat
+
+var (
+	namespaceRegexp = regexp.MustCompile(`^nvme(\d+)n(\d+)$`)
+	pathRegexp      = regexp.MustCompile(`^nvme(\d+)c\d+n(\d+)$`)
+	// generic character devices of namespaces, e.g. ng0n1 for nvme0n1
+	genericRegexp = regexp.MustCompile(`^ng(\d+)n(\d+)$`)
+)
+
+// nvme-cli has changed the casing of some keys between releases, the
+// variants are tried in order and any other key is looked up as is
+var fieldVariants = map[string][]string{
+	"DevicePath":   {"DevicePath", "devicepath"},
+	"SerialNumber": {"SerialNumber", "serial_number"},
+}
+
+func getField(result gjson.Result, key string) gjson.Result {
+	for _, variant := range fieldVariants[key] {
+		if value := result.Get(variant); value.Exists() {
+			return value
+		}
+	}
+	return result.Get(key)
+}
+
+type nvmeController struct {
+	Name      string
+	Transport string
+	Address   string
+	Discovery bool
+	// Model, Serial and Firmware are empty when nvme list doesn't report
+	// them, see controllerIdentity
+	Model    string
+	Serial   string
+	Firmware string
+	// Paths are the multipath paths through the controller
+	Paths []nvmePath
+}
+
+// inaccessible reports whether all paths through the controller are in the
+// inaccessible ANA state, so its namespaces can't be read through it
+func (c nvmeController) inaccessible() bool {
+	for _, path := range c.Paths {
+		if path.ANAState != "inaccessible" {
+			return false
+		}
+	}
+	return len(c.Paths) > 0
+}
+
+// nvmePath is the path of a controller to a multipath namespace, e.g.
+// nvme0c1n1 for nvme0n1 through controller nvme1
+type nvmePath struct {
+	Name     string
+	ANAState string
+}
+
+type nvmeNamespace struct {
+	DevicePath string
+	Controller string
+	// Identity is the NGUID or EUI64 of the namespace if reported, the same
+	// namespace reached through several paths has the same identity
+	Identity  string
+	Optimized bool
+	// Layout is the nvme list layout the namespace was found in
+	Layout string
+}
+
+// nvme list layouts, see getDeviceList. The namespaces layout nests
+// controllers and their namespaces under Subsystems.
+const (
+	layoutAuto        = "auto"
+	layoutNamespaces  = "namespaces"
+	layoutControllers = "controllers"
+	layoutDevicePaths = "devicepaths"
+)
+
+// parseListLayout validates a --list-layout value, subsystems is accepted
+// for the namespaces layout
+func parseListLayout(layout string) (string, error) {
+	switch layout {
+	case layoutAuto, layoutNamespaces, layoutControllers, layoutDevicePaths:
+		return layout, nil
+	case "subsystems":
+		return layoutNamespaces, nil
+	}
+	return "", fmt.Errorf("unknown nvme list layout %q, must be one of auto, namespaces, controllers or devicepaths", layout)
+}
+
+// getDeviceList parses the output of "nvme list -v -o json". Newer nvme-cli
+// releases nest controllers under Subsystems, older verbose output puts
+// Controllers and Namespaces directly on each device, and the oldest
+// releases only report a flat DevicePath per namespace. Some releases mix
+// these layouts in one output, so all of them are checked and namespaces
+// and controllers are de-duplicated by name. Namespaces reporting an NGUID
+// or EUI64 are also de-duplicated by it, so a multipath namespace reached
+// through several controllers is collected once, preferably through an
+// optimized path. layout restricts parsing to one layout, or checks all of
+// them when it is auto.
+func getDeviceList(nvmeListOutput []byte, layout string) ([]nvmeNamespace, []nvmeController, error) {
+	nvmeListOutput = trimJSON(nvmeListOutput)
+	if !gjson.ValidBytes(nvmeListOutput) {
+		return nil, nil, errors.New("nvme list json is not valid")
+	}
+	var namespaces []nvmeNamespace
+	var controllers []nvmeController
+	// index of each namespace by device path and by identity, so the same
+	// namespace is found whichever layouts report it and whether or not
+	// they report its identity
+	seenNamespaces := make(map[string]int)
+	seenControllers := make(map[string]bool)
+	add := func(layout string, ns []nvmeNamespace, ctrls []nvmeController) {
+		for _, n := range ns {
+			n.Layout = layout
+			i, seen := seenNamespaces[n.DevicePath]
+			if !seen && n.Identity != "" {
+				i, seen = seenNamespaces[n.Identity]
+			}
+			if !seen {
+				seenNamespaces[n.DevicePath] = len(namespaces)
+				if n.Identity != "" {
+					seenNamespaces[n.Identity] = len(namespaces)
+				}
+				namespaces = append(namespaces, n)
+				continue
+			}
+			// keep the optimized path to a multipath namespace
+			if n.Optimized && !namespaces[i].Optimized {
+				debugf("Using optimized path %s instead of %s\n", n.DevicePath, namespaces[i].DevicePath)
+				if n.Identity == "" {
+					n.Identity = namespaces[i].Identity
+				}
+				namespaces[i] = n
+				seenNamespaces[n.DevicePath] = i
+			}
+			if namespaces[i].Identity == "" && n.Identity != "" {
+				namespaces[i].Identity = n.Identity
+				seenNamespaces[n.Identity] = i
+			}
+		}
+		for _, c := range ctrls {
+			if !seenControllers[c.Name] {
+				seenControllers[c.Name] = true
+				controllers = append(controllers, c)
+			}
+		}
+	}
+	parses := func(l string) bool {
+		return layout == layoutAuto || layout == l
+	}
+	for i, device := range gjson.GetBytes(nvmeListOutput, "Devices").Array() {
+		if subsystems := getField(device, "Subsystems"); subsystems.Exists() && parses(layoutNamespaces) {
+			debugf("nvme list device %d matched the namespaces layout\n", i)
+			for _, subsystem := range subsystems.Array() {
+				ns, ctrls := parseSubsystem(subsystem)
+				add(layoutNamespaces, ns, ctrls)
+			}
+		}
+		if (getField(device, "Controllers").Exists() || getField(device, "Namespaces").Exists()) && parses(layoutControllers) {
+			debugf("nvme list device %d matched the controllers layout\n", i)
+			ns, ctrls := parseSubsystem(device)
+			add(layoutControllers, ns, ctrls)
+		}
+		if getField(device, "DevicePath").Exists() && parses(layoutDevicePaths) {
+			debugf("nvme list device %d matched the device path layout\n", i)
+			devicePath := getField(device, "DevicePath").String()
+			controller := controllerFromNamespace(filepath.Base(devicePath))
+			add(layoutDevicePaths, []nvmeNamespace{{
+				DevicePath: devicePath,
+				Controller: controller,
+				Identity:   namespaceIdentity(device),
+			}}, []nvmeController{{
+				Name:     controller,
+				Model:    strings.TrimSpace(getField(device, "ModelNumber").String()),
+				Serial:   strings.TrimSpace(getField(device, "SerialNumber").String()),
+				Firmware: strings.TrimSpace(getField(device, "Firmware").String()),
+			}})
+		}
+	}
+	return namespaces, controllers, nil
+}
+
+// appendListedNamespaces enumerates namespaces with "nvme list-ns" for
+// controllers that nvme list reported without any namespaces, which happens
+// in some fabrics setups.
+func appendListedNamespaces(runner commandRunner, namespaces []nvmeNamespace, controllers []nvmeController) []nvmeNamespace {
+	hasNamespaces := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, namespace := range namespaces {
+		hasNamespaces[namespace.Controller] = true
+		seen[namespace.DevicePath] = true
+	}
+	for _, controller := range controllers {
+		if controller.Discovery || hasNamespaces[controller.Name] {
+			continue
+		}
+		nvmeListNs, err := runNvmeJSON(runner, "list-ns", "/dev/"+controller.Name, "-o", "json")
+		if err != nil {
+			warnf("Error running nvme list-ns command for controller %s: %s\n", controller.Name, err)
+			continue
+		}
+		if !gjson.ValidBytes(nvmeListNs) {
+			warnf("nvme list-ns json is not valid for controller: %s\n", controller.Name)
+			continue
+		}
+		for _, nsid := range gjson.GetBytes(nvmeListNs, "nsid_list.#.nsid").Array() {
+			devicePath := "/dev/" + controller.Name + "n" + nsid.String()
+			if seen[devicePath] {
+				continue
+			}
+			if _, err := statDevice(devicePath); err != nil {
+				debugf("Skipping namespace %s of controller %s: %s\n", nsid.String(), controller.Name, err)
+				continue
+			}
+			seen[devicePath] = true
+			namespaces = append(namespaces, nvmeNamespace{
+				DevicePath: devicePath,
+				Controller: controller.Name,
+			})
+		}
+	}
+	return namespaces
+}
+
+// trimJSON strips a UTF-8 byte order mark and any bytes before the first
+// opening or after the last closing brace or bracket, such as terminal
+// escape sequences added by wrappers around nvme-cli.
+func trimJSON(output []byte) []byte {
+	output = bytes.TrimPrefix(output, []byte("\xef\xbb\xbf"))
+	start := bytes.IndexAny(output, "{[")
+	end := bytes.LastIndexAny(output, "}]")
+	if start < 0 || end < start {
+		return output
+	}
+	return output[start : end+1]
+}
+
+func parseSubsystem(subsystem gjson.Result) ([]nvmeNamespace, []nvmeController) {
+	var namespaces []nvmeNamespace
+	var controllers []nvmeController
+	nqn := getField(subsystem, "SubsystemNQN").String()
+	for _, c := range getField(subsystem, "Controllers").Array() {
+		ctrl := nvmeController{
+			Name:      getField(c, "Controller").String(),
+			Transport: c.Get("Transport").String(),
+			Address:   c.Get("Address").String(),
+			Model:     strings.TrimSpace(getField(c, "ModelNumber").String()),
+			Serial:    strings.TrimSpace(getField(c, "SerialNumber").String()),
+			Firmware:  strings.TrimSpace(getField(c, "Firmware").String()),
+		}
+		ctrl.Discovery = isDiscoveryController(ctrl.Name, nqn)
+		// discovery controllers have no namespaces and no smart-log
+		if ctrl.Discovery {
+			controllers = append(controllers, ctrl)
+			continue
+		}
+		optimized := false
+		for _, p := range getField(c, "Paths").Array() {
+			path := nvmePath{
+				Name:     getField(p, "Path").String(),
+				ANAState: getField(p, "ANAState").String(),
+			}
+			if path.ANAState == "optimized" {
+				optimized = true
+			}
+			ctrl.Paths = append(ctrl.Paths, path)
+		}
+		for _, ns := range getField(c, "Namespaces").Array() {
+			namespaces = append(namespaces, nvmeNamespace{
+				DevicePath: "/dev/" + namespaceName(ns),
+				Controller: ctrl.Name,
+				Identity:   namespaceIdentity(ns),
+				Optimized:  optimized,
+			})
+		}
+		controllers = append(controllers, ctrl)
+	}
+	// multipath namespaces are reported once per subsystem, attribute them
+	// to the first controller with an accessible path to the namespace
+	for _, ns := range getField(subsystem, "Namespaces").Array() {
+		name := namespaceName(ns)
+		namespaces = append(namespaces, nvmeNamespace{
+			DevicePath: "/dev/" + name,
+			Controller: pathController(subsystem, name),
+			Identity:   namespaceIdentity(ns),
+		})
+	}
+	return namespaces, controllers
+}
+
+// controllerIdentity returns the model, serial number and firmware revision
+// of a controller from nvme list, falling back to its id-ctrl output for
+// nvme-cli releases that don't report them
+func controllerIdentity(controller nvmeController, idCtrl gjson.Result) (string, string, string) {
+	model, serial, firmware := controller.Model, controller.Serial, controller.Firmware
+	if model == "" {
+		model = strings.TrimSpace(idCtrl.Get("mn").String())
+	}
+	if serial == "" {
+		serial = strings.TrimSpace(idCtrl.Get("sn").String())
+	}
+	if firmware == "" {
+		firmware = strings.TrimSpace(idCtrl.Get("fr").String())
+	}
+	return model, serial, firmware
+}
+
+// namespaceName returns the block device name of a namespace, or its
+// generic character device (ng) when there is no block device, as in some
+// fabrics and virtualized setups.
+func namespaceName(ns gjson.Result) string {
+	if name := getField(ns, "NameSpace").String(); name != "" {
+		return name
+	}
+	return getField(ns, "Generic").String()
+}
+
+// isGenericDevice reports whether a device path is a generic character
+// device, which has no block device statistics in sysfs
+func isGenericDevice(devicePath string) bool {
+	return genericRegexp.MatchString(filepath.Base(devicePath))
+}
+
+// namespaceIdentity returns the NGUID, or else the EUI64, of a namespace
+// in the "eui." form the kernel uses for wwids. Drives that don't implement
+// them report all zeros.
+func namespaceIdentity(ns gjson.Result) string {
+	for _, key := range []string{"NGUID", "EUI64"} {
+		id := strings.ToLower(strings.NewReplacer("-", "", ":", "").Replace(getField(ns, key).String()))
+		if strings.Trim(id, "0") != "" {
+			return "eui." + id
+		}
+	}
+	return ""
+}
+
+// stableID identifies a namespace across device renumbering by its NGUID or
+// EUI64, or else by the serial number of its controller and its namespace
+// id. It is empty when neither is known.
+func stableID(namespace nvmeNamespace, idCtrl gjson.Result) string {
+	if namespace.Identity != "" {
+		return namespace.Identity
+	}
+	serial := strings.TrimSpace(idCtrl.Get("sn").String())
+	nsid := namespaceID(namespace.DevicePath)
+	if serial == "" || nsid == "" {
+		return ""
+	}
+	return "nvme." + serial + "-" + nsid
+}
+
+// pathController returns the controller holding a path (nvmeXcYnZ) to the
+// multipath namespace nvmeXnZ, falling back to the first controller.
+func pathController(subsystem gjson.Result, namespace string) string {
+	controllers := getField(subsystem, "Controllers").Array()
+	ns := namespaceRegexp.FindStringSubmatch(namespace)
+	if ns == nil {
+		ns = genericRegexp.FindStringSubmatch(namespace)
+	}
+	if ns != nil {
+		// prefer a path the namespace is accessible through
+		first := ""
+		for _, c := range controllers {
+			for _, p := range getField(c, "Paths").Array() {
+				path := pathRegexp.FindStringSubmatch(getField(p, "Path").String())
+				if path == nil || path[1] != ns[1] || path[2] != ns[2] {
+					continue
+				}
+				if getField(p, "ANAState").String() != "inaccessible" {
+					return getField(c, "Controller").String()
+				}
+				if first == "" {
+					first = getField(c, "Controller").String()
+				}
+			}
+		}
+		if first != "" {
+			return first
+		}
+	}
+	if len(controllers) > 0 {
+		return getField(controllers[0], "Controller").String()
+	}
+	return controllerFromNamespace(namespace)
+}
+
+// controllerFromNamespace derives the controller name from a non-multipath
+// namespace name, e.g. nvme0n1 -> nvme0, or generic device, e.g. ng0n1 -> nvme0
+func controllerFromNamespace(namespace string) string {
+	if m := namespaceRegexp.FindStringSubmatch(namespace); m != nil {
+		return "nvme" + m[1]
+	}
+	if m := genericRegexp.FindStringSubmatch(namespace); m != nil {
+		return "nvme" + m[1]
+	}
+	return namespace
+}
+
+// pathNamespace returns the namespace device of a multipath path, e.g.
+// /dev/nvme0n1 for nvme0c1n1, or "" for names that aren't paths
+func pathNamespace(path string) string {
+	if m := pathRegexp.FindStringSubmatch(path); m != nil {
+		return "/dev/nvme" + m[1] + "n" + m[2]
+	}
+	return ""
+}
+
+// isDiscoveryController prefers the kernel's cntrltype attribute and falls
+// back to the well-known discovery NQN when sysfs is unavailable.
+func isDiscoveryController(controller string, nqn string) bool {
+	cntrltype, err := readSysfsAttr(controller, "cntrltype")
+	if err == nil {
+		return cntrltype == "discovery"
+	}
+	return nqn == discoveryNQN
+}
+
+// fabricAddress parses the traddr and trsvcid out of a fabrics controller
+// address such as "traddr=10.50.4.15,trsvcid=4421" into "10.50.4.15:4421".
+// Transports without a service id, like fc, return the traddr alone.
+func fabricAddress(address string) string {
+	var traddr, trsvcid string
+	for _, field := range strings.Split(address, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "traddr":
+			traddr = kv[1]
+		case "trsvcid":
+			trsvcid = kv[1]
+		}
+	}
+	if trsvcid == "" {
+		return traddr
+	}
+	return net.JoinHostPort(traddr, trsvcid)
+}
+
+func readSysfsAttr(controller string, attr string) (string, error) {
+	value, err := ioutil.ReadFile(filepath.Join(sysClassNvme, controller, attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
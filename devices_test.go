@@ -0,0 +1,414 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// testMixedNvmeList mixes the layouts of nvme-cli releases: nvme0n1 nested
+// under Subsystems, nvme1n1 with Controllers and Namespaces on the device
+// and nvme2n1 with only a DevicePath
+const testMixedNvmeList = `{
+  "Devices": [
+    {
+      "Subsystems": [{
+        "SubsystemNQN": "nqn.2019-10.com.example:ns",
+        "Controllers": [{"Controller": "nvme0", "Namespaces": [{"NameSpace": "nvme0n1"}]}]
+      }]
+    },
+    {
+      "Controllers": [{"Controller": "nvme1", "Namespaces": [{"NameSpace": "nvme1n1"}]}]
+    },
+    {
+      "DevicePath": "/dev/nvme2n1",
+      "ModelNumber": "Old Drive",
+      "SerialNumber": "OLD1"
+    }
+  ]
+}`
+
+func TestGetDeviceListLayouts(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   map[string]string
+	}{
+		{layoutAuto, map[string]string{
+			"/dev/nvme0n1": layoutNamespaces,
+			"/dev/nvme1n1": layoutControllers,
+			"/dev/nvme2n1": layoutDevicePaths,
+		}},
+		{layoutNamespaces, map[string]string{"/dev/nvme0n1": layoutNamespaces}},
+		{layoutControllers, map[string]string{"/dev/nvme1n1": layoutControllers}},
+		{layoutDevicePaths, map[string]string{"/dev/nvme2n1": layoutDevicePaths}},
+	}
+	for _, test := range tests {
+		namespaces, _, err := getDeviceList([]byte(testMixedNvmeList), test.layout)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.layout, err)
+		}
+		got := make(map[string]string)
+		for _, namespace := range namespaces {
+			got[namespace.DevicePath] = namespace.Layout
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: layouts = %v, want %v", test.layout, got, test.want)
+			continue
+		}
+		for device, layout := range test.want {
+			if got[device] != layout {
+				t.Errorf("%s: layout of %s = %q, want %q", test.layout, device, got[device], layout)
+			}
+		}
+	}
+}
+
+func TestParseListLayout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"auto", layoutAuto, false},
+		{"namespaces", layoutNamespaces, false},
+		{"subsystems", layoutNamespaces, false},
+		{"controllers", layoutControllers, false},
+		{"devicepaths", layoutDevicePaths, false},
+		{"flat", "", true},
+	}
+	for _, test := range tests {
+		got, err := parseListLayout(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseListLayout(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseListLayout(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTrimJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"plain", `{"Devices": []}`, `{"Devices": []}`},
+		{"byte order mark", "\xef\xbb\xbf{\"Devices\": []}", `{"Devices": []}`},
+		{"trailing garbage", "{\"Devices\": []}\n\x1b[0m", `{"Devices": []}`},
+		{"leading text", "using nvme-cli 2.4\n{\"Devices\": []}", `{"Devices": []}`},
+		{"array root", "\xef\xbb\xbf[{\"sn\": \"S123\"}]\n", `[{"sn": "S123"}]`},
+		{"no json", "No NVMe devices detected.\n", "No NVMe devices detected.\n"},
+	}
+	for _, test := range tests {
+		if got := string(trimJSON([]byte(test.output))); got != test.want {
+			t.Errorf("%s: trimJSON() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetDeviceListByteOrderMark(t *testing.T) {
+	namespaces, _, err := getDeviceList([]byte("\xef\xbb\xbf"+testMixedNvmeList+"\n\x1b[0m"), layoutAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(namespaces) != 3 {
+		t.Errorf("found %d namespaces, want 3", len(namespaces))
+	}
+}
+
+// testControllerOnlyNvmeList has a fabrics controller listed without its
+// namespaces
+const testControllerOnlyNvmeList = `{"Devices": [{"Subsystems": [{
+  "SubsystemNQN": "nqn.2019-10.com.example:fabrics",
+  "Controllers": [{"Controller": "nvme3", "Transport": "tcp", "Address": "traddr=10.0.0.1,trsvcid=4420"}]
+}]}]}`
+
+func TestListNsFallback(t *testing.T) {
+	useTestSysfs(t)
+	oldStatDevice := statDevice
+	defer func() { statDevice = oldStatDevice }()
+	// namespace 3 has no device node
+	statDevice = func(path string) (os.FileInfo, error) {
+		if path == "/dev/nvme3n3" {
+			return nil, os.ErrNotExist
+		}
+		return nil, nil
+	}
+	runner := fakeRunner{
+		"list":                   testControllerOnlyNvmeList,
+		"id-ctrl":                testIdCtrl,
+		"list-ns":                `{"nsid_list": [{"nsid": 1}, {"nsid": 2}, {"nsid": 3}]}`,
+		"smart-log /dev/nvme3n1": `{"temperature": 300}`,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_temperature"]; ok {
+		t.Errorf("nvme_temperature exported without list-ns-fallback")
+	}
+	config := testCollectorConfig(runner)
+	config.listNsFallback = true
+	families = gatherMetrics(t, newNvmeCollector(config))
+	// smart-log is controller wide and read through the first namespace
+	if got, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme3n1"); !ok || got != 26.85 {
+		t.Errorf("nvme_temperature of /dev/nvme3n1 = %v, %v, want 26.85", got, ok)
+	}
+	if got, ok := metricValue(families, "nvme_namespace_count", "controller", "nvme3"); !ok || got != 2 {
+		t.Errorf("nvme_namespace_count = %v, %v, want 2 without the missing device node", got, ok)
+	}
+
+}
+
+func TestControllerWithoutNamespaces(t *testing.T) {
+	namespaces, controllers, err := getDeviceList([]byte(testControllerOnlyNvmeList), layoutAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(namespaces) != 0 {
+		t.Errorf("found %d namespaces, want none", len(namespaces))
+	}
+	if len(controllers) != 1 || controllers[0].Name != "nvme3" {
+		t.Fatalf("controllers = %+v, want nvme3", controllers)
+	}
+	useTestSysfs(t)
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":    testControllerOnlyNvmeList,
+		"id-ctrl": `{"sn": "S789", "tnvmcap": 3840755982336}`,
+	})))
+	if got, ok := metricValue(families, "nvme_total_capacity", "controller", "nvme3"); !ok || got != 3840755982336 {
+		t.Errorf("nvme_total_capacity = %v, %v, want 3840755982336", got, ok)
+	}
+	if got, ok := metricValue(families, "nvme_namespace_count", "controller", "nvme3"); !ok || got != 0 {
+		t.Errorf("nvme_namespace_count = %v, %v, want 0", got, ok)
+	}
+}
+
+func TestFabricAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"traddr=10.50.4.15,trsvcid=4421", "10.50.4.15:4421"},
+		{"traddr=10.50.4.15,trsvcid=8009,src_addr=10.50.4.2", "10.50.4.15:8009"},
+		{"trsvcid=4420, traddr=192.168.1.2", "192.168.1.2:4420"},
+		{"traddr=fe80::1,trsvcid=4420", "[fe80::1]:4420"},
+		// fc has no service id
+		{"traddr=nn-0x20000090fa942779:pn-0x10000090fa942779,host_traddr=nn-0x20000090fa942778:pn-0x10000090fa942778", "nn-0x20000090fa942779:pn-0x10000090fa942779"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := fabricAddress(test.address); got != test.want {
+			t.Errorf("fabricAddress(%q) = %q, want %q", test.address, got, test.want)
+		}
+	}
+}
+
+// testMultipathNvmeList reaches the same namespace through a non-optimized
+// path of nvme0 and an optimized path of nvme1, next to two namespaces
+// without an NGUID
+const testMultipathNvmeList = `{"Devices": [{"Subsystems": [
+  {"SubsystemNQN": "nqn.2019-10.com.example:shared", "Controllers": [
+    {"Controller": "nvme0", "Transport": "tcp", "Paths": [{"Path": "nvme0c0n1", "ANAState": "non-optimized"}],
+     "Namespaces": [{"NameSpace": "nvme0n1", "NGUID": "0123456789abcdef0123456789abcdef"}]},
+    {"Controller": "nvme1", "Transport": "tcp", "Paths": [{"Path": "nvme0c1n1", "ANAState": "optimized"}],
+     "Namespaces": [{"NameSpace": "nvme1n1", "NGUID": "01234567-89ab-cdef-0123-456789abcdef"}]}
+  ]},
+  {"SubsystemNQN": "nqn.2019-10.com.example:local", "Controllers": [
+    {"Controller": "nvme2", "Namespaces": [
+      {"NameSpace": "nvme2n1", "NGUID": "00000000000000000000000000000000"},
+      {"NameSpace": "nvme2n2", "NGUID": "00000000000000000000000000000000"}
+    ]}
+  ]}
+]}]}`
+
+func TestGetDeviceListMultipath(t *testing.T) {
+	namespaces, controllers, err := getDeviceList([]byte(testMultipathNvmeList), layoutAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var devices []string
+	for _, namespace := range namespaces {
+		devices = append(devices, namespace.DevicePath)
+	}
+	// namespaces without an NGUID aren't de-duplicated
+	want := []string{"/dev/nvme1n1", "/dev/nvme2n1", "/dev/nvme2n2"}
+	if strings.Join(devices, " ") != strings.Join(want, " ") {
+		t.Fatalf("namespaces = %v, want %v", devices, want)
+	}
+	if namespaces[0].Controller != "nvme1" {
+		t.Errorf("shared namespace collected through %s, want the optimized path of nvme1", namespaces[0].Controller)
+	}
+	if len(controllers) != 3 {
+		t.Errorf("found %d controllers, want 3", len(controllers))
+	}
+}
+
+func TestMultipathNamespaceCollectedOnce(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testMultipathNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if n := len(families["nvme_temperature"].GetMetric()); n != 2 {
+		t.Errorf("nvme_temperature has %d series, want one per controller with namespaces", n)
+	}
+	if _, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); ok {
+		t.Errorf("nvme_temperature collected through the non-optimized path")
+	}
+}
+
+// testGenericNvmeList only has generic character devices: ng3n1 on nvme3
+// and the multipath ng1n1 reached through nvme0, which is inaccessible,
+// and nvme2
+const testGenericNvmeList = `{"Devices": [{"Subsystems": [
+  {"SubsystemNQN": "nqn.2019-10.com.example:multipath", "Controllers": [
+    {"Controller": "nvme0", "Paths": [{"Path": "nvme1c0n1", "ANAState": "inaccessible"}]},
+    {"Controller": "nvme2", "Paths": [{"Path": "nvme1c2n1", "ANAState": "optimized"}]}
+  ], "Namespaces": [{"Generic": "ng1n1", "NSID": 1}]},
+  {"SubsystemNQN": "nqn.2019-10.com.example:local", "Controllers": [
+    {"Controller": "nvme3", "Namespaces": [{"Generic": "ng3n1", "NSID": 1}]}
+  ]}
+]}]}`
+
+func TestGetDeviceListGenericOnly(t *testing.T) {
+	namespaces, _, err := getDeviceList([]byte(testGenericNvmeList), layoutAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]string{"/dev/ng1n1": "nvme2", "/dev/ng3n1": "nvme3"}
+	if len(namespaces) != len(want) {
+		t.Fatalf("namespaces = %+v, want %v", namespaces, want)
+	}
+	for _, namespace := range namespaces {
+		if controller, ok := want[namespace.DevicePath]; !ok || namespace.Controller != controller {
+			t.Errorf("namespace %s on controller %s, want %q", namespace.DevicePath, namespace.Controller, controller)
+		}
+		if !isGenericDevice(namespace.DevicePath) {
+			t.Errorf("%s isn't a generic device", namespace.DevicePath)
+		}
+		if nsid := namespaceID(namespace.DevicePath); nsid != "1" {
+			t.Errorf("namespace id of %s = %q, want 1", namespace.DevicePath, nsid)
+		}
+	}
+}
+
+func TestCollectGenericOnly(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testGenericNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	families := gatherMetrics(t, newNvmeCollector(config))
+	for _, device := range []string{"/dev/ng1n1", "/dev/ng3n1"} {
+		if got, ok := metricValue(families, "nvme_temperature", "device", device); !ok || got != 36.85 {
+			t.Errorf("nvme_temperature{device=%q} = %v, %v, want 36.85", device, got, ok)
+		}
+	}
+	if _, ok := metricValue(families, "nvme_device_info", "device", "/dev/ng1n1", "controller", "nvme2"); !ok {
+		t.Errorf("nvme_device_info of /dev/ng1n1 isn't on controller nvme2")
+	}
+}
+
+func TestStableID(t *testing.T) {
+	idCtrl := gjson.Parse(`{"sn": "  S123  "}`)
+	tests := []struct {
+		name   string
+		list   string
+		idCtrl gjson.Result
+		want   string
+	}{
+		{"nguid", `{"Devices": [{"Controllers": [{"Controller": "nvme3", "Namespaces": [{"NameSpace": "nvme3n1", "NGUID": "0123456789ABCDEF0123456789ABCDEF"}]}]}]}`, idCtrl, "eui.0123456789abcdef0123456789abcdef"},
+		// renumbered after a reboot, with the NGUID formatted by another nvme-cli release
+		{"renumbered nguid", `{"Devices": [{"Controllers": [{"Controller": "nvme5", "Namespaces": [{"NameSpace": "nvme5n1", "NGUID": "01234567-89ab-cdef-0123-456789abcdef"}]}]}]}`, idCtrl, "eui.0123456789abcdef0123456789abcdef"},
+		{"eui64", `{"Devices": [{"Controllers": [{"Controller": "nvme3", "Namespaces": [{"NameSpace": "nvme3n1", "NGUID": "00000000000000000000000000000000", "EUI64": "00:11:22:33:44:55:66:77"}]}]}]}`, idCtrl, "eui.0011223344556677"},
+		// without an NGUID or EUI64 the serial and namespace id
+		{"serial", `{"Devices": [{"Controllers": [{"Controller": "nvme3", "Namespaces": [{"NameSpace": "nvme3n2"}]}]}]}`, idCtrl, "nvme.S123-2"},
+		{"renumbered serial", `{"Devices": [{"Controllers": [{"Controller": "nvme5", "Namespaces": [{"NameSpace": "nvme5n2"}]}]}]}`, idCtrl, "nvme.S123-2"},
+		{"unknown", `{"Devices": [{"Controllers": [{"Controller": "nvme3", "Namespaces": [{"NameSpace": "nvme3n2"}]}]}]}`, gjson.Result{}, ""},
+	}
+	for _, test := range tests {
+		namespaces, _, err := getDeviceList([]byte(test.list), layoutAuto)
+		if err != nil || len(namespaces) != 1 {
+			t.Fatalf("%s: getDeviceList() = %+v, %v, want one namespace", test.name, namespaces, err)
+		}
+		if got := stableID(namespaces[0], test.idCtrl); got != test.want {
+			t.Errorf("%s: stableID() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// testOverlappingNvmeList reports nvme0n1 in the Subsystems layout, the
+// Controllers layout and the flat DevicePath layout, and nvme1n1, known by
+// its EUI64, in the Subsystems and DevicePath layouts
+const testOverlappingNvmeList = `{"Devices": [
+  {"Subsystems": [{"SubsystemNQN": "nqn.2019-10.com.example:test", "Controllers": [
+    {"Controller": "nvme0", "Namespaces": [{"NameSpace": "nvme0n1", "NGUID": "0123456789abcdef0123456789abcdef"}]},
+    {"Controller": "nvme1", "Namespaces": [{"NameSpace": "nvme1n1", "NGUID": "00000000000000000000000000000000", "EUI64": "0011223344556677"}]}
+  ]}]},
+  {"Controllers": [{"Controller": "nvme0", "Namespaces": [{"NameSpace": "nvme0n1", "NGUID": "0123456789abcdef0123456789abcdef"}]}]},
+  {"DevicePath": "/dev/nvme0n1", "ModelNumber": "Example NVMe", "SerialNumber": "S123"},
+  {"DevicePath": "/dev/nvme1n1", "ModelNumber": "Example NVMe", "SerialNumber": "S456", "EUI64": "0011223344556677"}
+]}`
+
+func TestGetDeviceListOverlappingLayouts(t *testing.T) {
+	namespaces, controllers, err := getDeviceList([]byte(testOverlappingNvmeList), layoutAuto)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	identities := make(map[string]string)
+	for _, namespace := range namespaces {
+		if other, ok := identities[namespace.Identity]; ok {
+			t.Errorf("%s and %s have the same identity %q", other, namespace.DevicePath, namespace.Identity)
+		}
+		identities[namespace.Identity] = namespace.DevicePath
+	}
+	want := map[string]string{
+		"eui.0123456789abcdef0123456789abcdef": "/dev/nvme0n1",
+		"eui.0011223344556677":                 "/dev/nvme1n1",
+	}
+	if len(namespaces) != len(want) {
+		t.Fatalf("namespaces = %+v, want one per identity %v", namespaces, want)
+	}
+	for identity, device := range want {
+		if identities[identity] != device {
+			t.Errorf("namespace with identity %s = %q, want %s", identity, identities[identity], device)
+		}
+	}
+	// the first layout reporting a namespace is kept
+	for _, namespace := range namespaces {
+		if namespace.Layout != layoutNamespaces {
+			t.Errorf("%s parsed from the %s layout, want %s", namespace.DevicePath, namespace.Layout, layoutNamespaces)
+		}
+	}
+	if len(controllers) != 2 {
+		t.Errorf("controllers = %+v, want nvme0 and nvme1", controllers)
+	}
+}
+
+func TestGetDeviceListKeyCasing(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"canonical", `{"Devices": [{"DevicePath": "/dev/nvme0n1", "ModelNumber": "Example NVMe", "SerialNumber": "S123"}]}`},
+		{"lower case", `{"Devices": [{"devicepath": "/dev/nvme0n1", "ModelNumber": "Example NVMe", "serial_number": "S123"}]}`},
+	}
+	for _, test := range tests {
+		namespaces, controllers, err := getDeviceList([]byte(test.output), layoutAuto)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if len(namespaces) != 1 || namespaces[0].DevicePath != "/dev/nvme0n1" {
+			t.Errorf("%s: namespaces = %+v, want /dev/nvme0n1", test.name, namespaces)
+		}
+		if len(controllers) != 1 || controllers[0].Serial != "S123" {
+			t.Errorf("%s: controllers = %+v, want serial S123", test.name, controllers)
+		}
+	}
+}
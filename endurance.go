@@ -0,0 +1,113 @@
+package main
+
+// Export wear metrics from the endurance group information log
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var enduranceLabels = []string{"controller", "endgid"}
+
+type enduranceCollector struct {
+	nvmeEnduranceEstimatedTotalWrites *prometheus.Desc
+	nvmeEnduranceDataUnitsRead        *prometheus.Desc
+	nvmeEnduranceDataUnitsWritten     *prometheus.Desc
+	nvmeEnduranceAvailSpare           *prometheus.Desc
+	nvmeEndurancePercentUsed          *prometheus.Desc
+	runner                            commandRunner
+}
+
+func newEnduranceCollector(runner commandRunner) *enduranceCollector {
+	return &enduranceCollector{
+		nvmeEnduranceEstimatedTotalWrites: prometheus.NewDesc(
+			metricName("endurance_estimated_total_writes"),
+			"Estimated total data that may be written to the endurance group over its life in billions of bytes",
+			enduranceLabels,
+			nil,
+		),
+		nvmeEnduranceDataUnitsRead: prometheus.NewDesc(
+			metricName("endurance_data_units_read"),
+			"Number of 512,000 byte data units read from the endurance group",
+			enduranceLabels,
+			nil,
+		),
+		nvmeEnduranceDataUnitsWritten: prometheus.NewDesc(
+			metricName("endurance_data_units_written"),
+			"Number of 512,000 byte data units written to the endurance group",
+			enduranceLabels,
+			nil,
+		),
+		nvmeEnduranceAvailSpare: prometheus.NewDesc(
+			metricName("endurance_avail_spare"),
+			"Normalized percentage of remaining spare capacity available to the endurance group",
+			enduranceLabels,
+			nil,
+		),
+		nvmeEndurancePercentUsed: prometheus.NewDesc(
+			metricName("endurance_percent_used"),
+			"Vendor specific estimate of the percentage of life of the endurance group used",
+			enduranceLabels,
+			nil,
+		),
+		runner: runner,
+	}
+}
+
+func (c *enduranceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeEnduranceEstimatedTotalWrites
+	ch <- c.nvmeEnduranceDataUnitsRead
+	ch <- c.nvmeEnduranceDataUnitsWritten
+	ch <- c.nvmeEnduranceAvailSpare
+	ch <- c.nvmeEndurancePercentUsed
+}
+
+// collect reads the log of each endurance group the devices of the
+// controller belong to. Rather than every group up to endgidmax, which can
+// be large, the groups are read from the endgid of each device's id-ns, so a
+// scrape runs one id-ns per device and one endurance-log per group in use.
+func (c *enduranceCollector) collect(ch chan<- prometheus.Metric, controller string, devices []string) {
+	for _, group := range c.enduranceGroups(devices) {
+		endgid := strconv.FormatUint(group, 10)
+		nvmeEnduranceLog, err := runNvmeJSON(c.runner, "endurance-log", "/dev/"+controller, "--group-id="+endgid, "-o", "json")
+		if err != nil {
+			warnf("Skipping endurance-log metrics for controller %s group %s: %s\n", controller, endgid, err)
+			continue
+		}
+		if !gjson.ValidBytes(nvmeEnduranceLog) {
+			warnf("Skipping endurance-log metrics for controller %s group %s: endurance-log json is not valid\n", controller, endgid)
+			continue
+		}
+		enduranceLog := gjson.ParseBytes(nvmeEnduranceLog)
+		ch <- prometheus.MustNewConstMetric(c.nvmeEnduranceEstimatedTotalWrites, prometheus.GaugeValue, enduranceLog.Get("endurance_estimate").Float(), controller, endgid)
+		ch <- prometheus.MustNewConstMetric(c.nvmeEnduranceDataUnitsRead, prometheus.CounterValue, enduranceLog.Get("data_units_read").Float(), controller, endgid)
+		ch <- prometheus.MustNewConstMetric(c.nvmeEnduranceDataUnitsWritten, prometheus.CounterValue, enduranceLog.Get("data_units_written").Float(), controller, endgid)
+		ch <- prometheus.MustNewConstMetric(c.nvmeEnduranceAvailSpare, prometheus.GaugeValue, enduranceLog.Get("avl_spare").Float(), controller, endgid)
+		ch <- prometheus.MustNewConstMetric(c.nvmeEndurancePercentUsed, prometheus.GaugeValue, enduranceLog.Get("percent_used").Float(), controller, endgid)
+	}
+}
+
+// enduranceGroups returns the distinct endurance groups of devices in
+// ascending order. endgid is 0 for namespaces without an endurance group.
+func (c *enduranceCollector) enduranceGroups(devices []string) []uint64 {
+	var groups []uint64
+	seen := make(map[uint64]bool)
+	for _, nvmeDevice := range devices {
+		nvmeIdNs, err := runNvmeJSON(c.runner, "id-ns", nvmeDevice, "-o", "json")
+		if err != nil {
+			warnf("Error running nvme id-ns command for endurance group of device %s: %s\n", nvmeDevice, err)
+			continue
+		}
+		endgid := gjson.GetBytes(nvmeIdNs, "endgid").Uint()
+		if endgid == 0 || seen[endgid] {
+			continue
+		}
+		seen[endgid] = true
+		groups = append(groups, endgid)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestEnduranceGroupsOfNamespaces(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list": `{"Devices": [{"Subsystems": [{"SubsystemNQN": "nqn.2019-10.com.example:test", "Controllers": [{
+  "Controller": "nvme0",
+  "Namespaces": [{"NameSpace": "nvme0n1"}, {"NameSpace": "nvme0n2"}, {"NameSpace": "nvme0n3"}, {"NameSpace": "nvme0n4"}]
+}]}]}]}`,
+		// endgidmax allows groups that no namespace belongs to
+		"id-ctrl":            `{"sn": "S123", "endgidmax": 64}`,
+		"smart-log":          testSmartLog,
+		"id-ns /dev/nvme0n1": `{"endgid": 2}`,
+		"id-ns /dev/nvme0n2": `{"endgid": 1}`,
+		"id-ns /dev/nvme0n3": `{"endgid": 2}`,
+		"id-ns /dev/nvme0n4": `{"endgid": 0}`,
+		"endurance-log /dev/nvme0 --group-id=1 -o json": `{"avl_spare": 98, "percent_used": 3, "endurance_estimate": 1200, "data_units_read": 100, "data_units_written": 200}`,
+		"endurance-log /dev/nvme0 --group-id=2 -o json": `{"avl_spare": 90, "percent_used": 7, "endurance_estimate": 2400, "data_units_read": 300, "data_units_written": 400}`,
+		"endurance-log": `{"avl_spare": 0}`,
+	})
+	config.collectEndurance = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	tests := []struct {
+		name   string
+		endgid string
+		want   float64
+	}{
+		{"nvme_endurance_avail_spare", "1", 98},
+		{"nvme_endurance_percent_used", "1", 3},
+		{"nvme_endurance_estimated_total_writes", "2", 2400},
+		{"nvme_endurance_data_units_written", "2", 400},
+	}
+	for _, test := range tests {
+		got, ok := metricValue(families, test.name, "controller", "nvme0", "endgid", test.endgid)
+		if !ok {
+			t.Errorf("%s{endgid=%q} is missing", test.name, test.endgid)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s{endgid=%q} = %v, want %v", test.name, test.endgid, got, test.want)
+		}
+	}
+	// only the groups of the namespaces are read
+	if n := len(families["nvme_endurance_avail_spare"].GetMetric()); n != 2 {
+		t.Errorf("nvme_endurance_avail_spare has %d series, want 2", n)
+	}
+}
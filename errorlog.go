@@ -0,0 +1,90 @@
+package main
+
+// Export metrics from the nvme error information log page
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var errorLogEntryLabels = []string{"controller", "error_index"}
+
+type errorLogCollector struct {
+	nvmeErrorLogUsedRatio   *prometheus.Desc
+	nvmeErrorLogEntries     *prometheus.Desc
+	nvmeErrorLogStatusField *prometheus.Desc
+	nvmeErrorLogCommandID   *prometheus.Desc
+	// maxEntries bounds the number of entries exported per controller
+	maxEntries int
+	runner     commandRunner
+}
+
+func newErrorLogCollector(runner commandRunner, maxEntries int) *errorLogCollector {
+	return &errorLogCollector{
+		nvmeErrorLogUsedRatio: prometheus.NewDesc(
+			metricName("error_log_used_ratio"),
+			"Ratio of populated error log entries to error log capacity",
+			controllerLabels,
+			nil,
+		),
+		nvmeErrorLogEntries: prometheus.NewDesc(
+			metricName("error_log_entries"),
+			"Number of populated error log entries",
+			controllerLabels,
+			nil,
+		),
+		nvmeErrorLogStatusField: prometheus.NewDesc(
+			metricName("error_log_status_field"),
+			"Status field of the completion of the command that failed, error_index 0 is the most recent entry",
+			errorLogEntryLabels,
+			nil,
+		),
+		nvmeErrorLogCommandID: prometheus.NewDesc(
+			metricName("error_log_command_id"),
+			"Command identifier of the command that failed, error_index 0 is the most recent entry",
+			errorLogEntryLabels,
+			nil,
+		),
+		maxEntries: maxEntries,
+		runner:     runner,
+	}
+}
+
+func (c *errorLogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeErrorLogUsedRatio
+	ch <- c.nvmeErrorLogEntries
+	ch <- c.nvmeErrorLogStatusField
+	ch <- c.nvmeErrorLogCommandID
+}
+
+func (c *errorLogCollector) collect(ch chan<- prometheus.Metric, controller string, capacity float64) {
+	controllerDevice := "/dev/" + controller
+	nvmeErrorLog, err := runNvmeJSON(c.runner, "error-log", controllerDevice, "-e", strconv.Itoa(int(capacity)), "-o", "json")
+	if err != nil {
+		warnf("Skipping error-log metrics for controller %s: %s\n", controller, err)
+		return
+	}
+	if !gjson.ValidBytes(nvmeErrorLog) {
+		warnf("Skipping error-log metrics for controller %s: error-log json is not valid\n", controller)
+		return
+	}
+	// unused entries are reported with an error count of 0, entries are
+	// ordered from the most recent
+	used := 0.0
+	for i, entry := range gjson.GetBytes(nvmeErrorLog, "errors").Array() {
+		if entry.Get("error_count").Uint() == 0 {
+			continue
+		}
+		used++
+		if i >= c.maxEntries {
+			continue
+		}
+		index := strconv.Itoa(i)
+		ch <- prometheus.MustNewConstMetric(c.nvmeErrorLogStatusField, prometheus.GaugeValue, entry.Get("status_field").Float(), controller, index)
+		ch <- prometheus.MustNewConstMetric(c.nvmeErrorLogCommandID, prometheus.GaugeValue, entry.Get("cmdid").Float(), controller, index)
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeErrorLogUsedRatio, prometheus.GaugeValue, used/capacity, controller)
+	ch <- prometheus.MustNewConstMetric(c.nvmeErrorLogEntries, prometheus.GaugeValue, used, controller)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestErrorLogUsedRatio(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   `{"sn": "S123", "elpe": 3}`,
+		"smart-log": testSmartLog,
+		// elpe 3 is a capacity of 4 entries, the last one unused
+		"error-log /dev/nvme0 -e 4 -o json": `{"errors": [
+  {"error_count": 12, "sqid": 1, "cmdid": 17, "status_field": 16385},
+  {"error_count": 11, "sqid": 1, "cmdid": 9, "status_field": 8194},
+  {"error_count": 10, "sqid": 0, "cmdid": 3, "status_field": 4},
+  {"error_count": 0, "sqid": 0, "cmdid": 0, "status_field": 0}
+]}`,
+	})
+	config.collectErrorLog = true
+	config.maxErrorLogEntries = 2
+	families := gatherMetrics(t, newNvmeCollector(config))
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"nvme_error_log_capacity", []string{"controller", "nvme0"}, 4},
+		{"nvme_error_log_entries", []string{"controller", "nvme0"}, 3},
+		{"nvme_error_log_used_ratio", []string{"controller", "nvme0"}, 0.75},
+		{"nvme_error_log_status_field", []string{"controller", "nvme0", "error_index", "0"}, 16385},
+		{"nvme_error_log_command_id", []string{"controller", "nvme0", "error_index", "1"}, 9},
+	}
+	for _, test := range tests {
+		if got, ok := metricValue(families, test.name, test.labels...); !ok || got != test.want {
+			t.Errorf("%s%v = %v, %v, want %v", test.name, test.labels, got, ok, test.want)
+		}
+	}
+	// entries past max-error-log-entries are counted but not exported
+	if n := len(families["nvme_error_log_status_field"].GetMetric()); n != 2 {
+		t.Errorf("nvme_error_log_status_field has %d series, want 2", n)
+	}
+}
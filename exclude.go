@@ -0,0 +1,59 @@
+package main
+
+// Drop metrics by name at runtime
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheus.Desc doesn't export its name, only its String form
+var descNameRegexp = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// excludeCollector suppresses the metrics of a collector whose names fully
+// match exclude
+type excludeCollector struct {
+	collector prometheus.Collector
+	exclude   *regexp.Regexp
+}
+
+// newExcludeCollector anchors expr like Prometheus relabeling regexes
+func newExcludeCollector(collector prometheus.Collector, expr string) (prometheus.Collector, error) {
+	exclude, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &excludeCollector{collector: collector, exclude: exclude}, nil
+}
+
+func (c *excludeCollector) excluded(desc *prometheus.Desc) bool {
+	m := descNameRegexp.FindStringSubmatch(desc.String())
+	return m != nil && c.exclude.MatchString(m[1])
+}
+
+func (c *excludeCollector) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.collector.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if !c.excluded(desc) {
+			ch <- desc
+		}
+	}
+}
+
+func (c *excludeCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		if !c.excluded(m.Desc()) {
+			ch <- m
+		}
+	}
+}
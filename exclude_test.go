@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExcludeCollector(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"temperature": 310, "temperature_sensor_1": 300, "temperature_sensor_2": 305}`,
+	}
+	collector, err := newExcludeCollector(newNvmeCollector(testCollectorConfig(runner)), `nvme_temperature_sensor.*`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	families := gatherMetrics(t, collector)
+	for name := range families {
+		if strings.HasPrefix(name, "nvme_temperature_sensor") {
+			t.Errorf("%s exported after excluding nvme_temperature_sensor.*", name)
+		}
+	}
+	// the regex matches the whole name
+	if got, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); !ok || got != 36.85 {
+		t.Errorf("nvme_temperature = %v, %v, want 36.85", got, ok)
+	}
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if strings.Contains(desc.String(), `fqName: "nvme_temperature_sensor`) {
+			t.Errorf("excluded metric described: %s", desc)
+		}
+	}
+	if _, err := newExcludeCollector(newNvmeCollector(testCollectorConfig(runner)), `nvme_(`); err == nil {
+		t.Errorf("expected an error for an invalid regex")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+// Run user-defined nvme commands and export values from their json output,
+// so vendor specific log pages can be collected without code changes.
+//
+// The file given with --extra-collectors-file holds a json list of
+// collectors, e.g.:
+//
+//	[
+//	  {
+//	    "name": "vendor_smart",
+//	    "args": ["vendor-plugin", "smart-log", "{device}", "-o", "json"],
+//	    "scope": "device",
+//	    "metrics": [
+//	      {"path": "media_wear", "name": "nvme_vendor_media_wear", "help": "Vendor media wear"}
+//	    ]
+//	  }
+//	]
+//
+// args are passed to nvme with {device} replaced by the namespace device
+// path and {controller} by the controller device path. Collectors with
+// scope "device" (the default) run once per namespace and are labeled by
+// device, collectors with scope "controller" run once per controller and are
+// labeled by controller. Each metric maps a gjson path to a gauge.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+type extraCollectorConfig struct {
+	Name    string   `json:"name"`
+	Args    []string `json:"args"`
+	Scope   string   `json:"scope"`
+	Metrics []struct {
+		Path string `json:"path"`
+		Name string `json:"name"`
+		Help string `json:"help"`
+	} `json:"metrics"`
+}
+
+type extraMetric struct {
+	path string
+	desc *prometheus.Desc
+}
+
+type extraCollector struct {
+	name    string
+	args    []string
+	scope   string
+	metrics []extraMetric
+}
+
+func loadExtraCollectors(path string) ([]*extraCollector, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []extraCollectorConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	builtin := builtinMetricNames()
+	names := make(map[string]bool)
+	metricNames := make(map[string]string)
+	var extraCollectors []*extraCollector
+	for _, config := range configs {
+		if config.Name == "" || len(config.Args) == 0 {
+			return nil, fmt.Errorf("extra collector %q must have a name and args", config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("extra collector %q is defined more than once", config.Name)
+		}
+		names[config.Name] = true
+		if config.Scope == "" {
+			config.Scope = "device"
+		}
+		if config.Scope != "device" && config.Scope != "controller" {
+			return nil, fmt.Errorf("extra collector %q has unknown scope %q", config.Name, config.Scope)
+		}
+		c := &extraCollector{name: config.Name, args: config.Args, scope: config.Scope}
+		for _, metric := range config.Metrics {
+			if !metricNameRegexp.MatchString(metric.Name) {
+				return nil, fmt.Errorf("extra collector %q has invalid metric name %q", config.Name, metric.Name)
+			}
+			if builtin[metric.Name] {
+				return nil, fmt.Errorf("extra collector %q metric %q collides with a built-in metric", config.Name, metric.Name)
+			}
+			if other, ok := metricNames[metric.Name]; ok {
+				return nil, fmt.Errorf("extra collector %q metric %q is already exported by extra collector %q", config.Name, metric.Name, other)
+			}
+			metricNames[metric.Name] = config.Name
+			help := metric.Help
+			if help == "" {
+				help = fmt.Sprintf("Value of %s from extra collector %s", metric.Path, config.Name)
+			}
+			c.metrics = append(c.metrics, extraMetric{
+				path: metric.Path,
+				desc: prometheus.NewDesc(metric.Name, help, []string{config.Scope}, nil),
+			})
+		}
+		extraCollectors = append(extraCollectors, c)
+	}
+	return extraCollectors, nil
+}
+
+// builtinMetricNames returns the names of the metrics registered with
+// newRegistry, with every collector enabled and the current metric prefix
+func builtinMetricNames() map[string]bool {
+	weights := defaultHealthScoreWeights()
+	c := newNvmeCollector(collectorConfig{
+		collectOCP:                  true,
+		collectErrorLog:             true,
+		collectNamespace:            true,
+		trackCounterResets:          true,
+		collectNamespaceControllers: true,
+		collectReservations:         true,
+		maxTempSensors:              8,
+		collectPersistentEventLog:   true,
+		compositeAsSensor0:          true,
+		adaptiveMaxInterval:         time.Minute,
+		healthScoreWeights:          &weights,
+		collectPowerStates:          true,
+		collectEndurance:            true,
+		collectFirmwareLog:          true,
+		alwaysEmit:                  true,
+	})
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		for _, collector := range append(runtimeCollectors(), c) {
+			collector.Describe(ch)
+		}
+		close(ch)
+	}()
+	names := make(map[string]bool)
+	for desc := range ch {
+		if m := descNameRegexp.FindStringSubmatch(desc.String()); m != nil {
+			names[m[1]] = true
+		}
+	}
+	return names
+}
+
+func (c *extraCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range c.metrics {
+		ch <- metric.desc
+	}
+}
+
+// collect runs the collector with runner for a namespace device or a
+// controller, label is the device path or controller name the metrics are labeled with
+func (c *extraCollector) collect(ch chan<- prometheus.Metric, runner commandRunner, nvmeDevice string, controller string, label string) {
+	replacer := strings.NewReplacer("{device}", nvmeDevice, "{controller}", "/dev/"+controller)
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		args[i] = replacer.Replace(arg)
+	}
+	output, err := runNvmeJSON(runner, args...)
+	if err != nil {
+		warnf("Skipping extra collector %s for %s: %s\n", c.name, label, err)
+		return
+	}
+	if !gjson.ValidBytes(output) {
+		warnf("Skipping extra collector %s for %s: json is not valid\n", c.name, label)
+		return
+	}
+	for _, metric := range c.metrics {
+		if value := gjson.GetBytes(output, metric.path); value.Exists() {
+			ch <- prometheus.MustNewConstMetric(metric.desc, prometheus.GaugeValue, value.Float(), label)
+		}
+	}
+}
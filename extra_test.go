@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testExtraCollectors = `[
+  {
+    "name": "vendor_smart",
+    "args": ["vendor-plugin", "smart-log", "{device}", "-o", "json"],
+    "metrics": [
+      {"path": "media_wear", "name": "nvme_vendor_media_wear", "help": "Vendor media wear"},
+      {"path": "nand.bytes_written", "name": "nvme_vendor_nand_bytes_written"},
+      {"path": "missing", "name": "nvme_vendor_missing"}
+    ]
+  }
+]`
+
+func writeExtraCollectors(t *testing.T, file string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "extra.json")
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtraCollector(t *testing.T) {
+	useTestSysfs(t)
+	extraCollectors, err := loadExtraCollectors(writeExtraCollectors(t, testExtraCollectors))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+		"vendor-plugin smart-log /dev/nvme0n1 -o json": `{"media_wear": 12, "nand": {"bytes_written": 4096}}`,
+	})
+	config.extraCollectors = extraCollectors
+	families := gatherMetrics(t, newNvmeCollector(config))
+	if got, _ := metricValue(families, "nvme_vendor_media_wear", "device", "/dev/nvme0n1"); got != 12 {
+		t.Errorf("nvme_vendor_media_wear = %v, want 12", got)
+	}
+	if got, _ := metricValue(families, "nvme_vendor_nand_bytes_written", "device", "/dev/nvme0n1"); got != 4096 {
+		t.Errorf("nvme_vendor_nand_bytes_written = %v, want 4096", got)
+	}
+	if _, ok := families["nvme_vendor_missing"]; ok {
+		t.Errorf("nvme_vendor_missing exported for a path missing from the output")
+	}
+	if got, _ := metricValue(families, "nvme_collector_enabled", "collector", "extra_vendor_smart"); got != 1 {
+		t.Errorf("nvme_collector_enabled{collector=\"extra_vendor_smart\"} = %v, want 1", got)
+	}
+}
+
+func TestLoadExtraCollectorsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"duplicate name", `[
+  {"name": "vendor", "args": ["vendor-log", "{device}"], "metrics": [{"path": "a", "name": "nvme_vendor_a"}]},
+  {"name": "vendor", "args": ["vendor-log", "{controller}"], "metrics": [{"path": "b", "name": "nvme_vendor_b"}]}
+]`, "defined more than once"},
+		{"duplicate metric", `[
+  {"name": "vendor_a", "args": ["vendor-log", "{device}"], "metrics": [{"path": "a", "name": "nvme_vendor_value"}]},
+  {"name": "vendor_b", "args": ["vendor-log", "{device}"], "metrics": [{"path": "b", "name": "nvme_vendor_value"}]}
+]`, "already exported by extra collector"},
+		{"built-in metric", `[
+  {"name": "vendor", "args": ["vendor-log", "{device}"], "metrics": [{"path": "temp", "name": "nvme_temperature"}]}
+]`, "collides with a built-in metric"},
+		{"built-in metric of a disabled collector", `[
+  {"name": "vendor", "args": ["vendor-log", "{device}"], "metrics": [{"path": "wear", "name": "nvme_endurance_percent_used"}]}
+]`, "collides with a built-in metric"},
+		{"go runtime metric", `[
+  {"name": "vendor", "args": ["vendor-log", "{device}"], "metrics": [{"path": "a", "name": "go_goroutines"}]}
+]`, "collides with a built-in metric"},
+		{"process metric", `[
+  {"name": "vendor", "args": ["vendor-log", "{device}"], "metrics": [{"path": "a", "name": "process_cpu_seconds_total"}]}
+]`, "collides with a built-in metric"},
+		{"no args", `[{"name": "vendor", "metrics": []}]`, "must have a name and args"},
+		{"unknown scope", `[{"name": "vendor", "args": ["vendor-log"], "scope": "subsystem"}]`, "unknown scope"},
+		{"invalid metric name", `[{"name": "vendor", "args": ["vendor-log"], "metrics": [{"path": "a", "name": "nvme-vendor"}]}]`, "invalid metric name"},
+	}
+	for _, test := range tests {
+		_, err := loadExtraCollectors(writeExtraCollectors(t, test.file))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q doesn't contain %q", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Read controller features with nvme get-feature
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// feature select values, see the Get Features command in the NVMe base
+// specification
+const (
+	featureSelectCurrent = 0
+	featureSelectDefault = 1
+)
+
+// nvme-cli prints the completion dword 0 of get-feature as e.g.
+// "get-feature:0x07 (Number of Queues), Current value:0x003f003f"
+var featureValueRegexp = regexp.MustCompile(`value:\s*(0x[0-9a-fA-F]+)`)
+
+// the Host Memory Buffer feature (0x0D) data structure decoded by
+// "nvme get-feature -H", e.g. "Host Memory Buffer Size (HSIZE): 8192"
+var hmbSizeRegexp = regexp.MustCompile(`\(HSIZE\):\s*(\d+)`)
+
+// hmbPageSize is the memory page size the host memory buffer size is
+// reported in, Linux always uses 4KiB controller pages
+const hmbPageSize = 4096
+
+// getFeature returns the value of feature fid, args are passed on to nvme
+// get-feature, e.g. "-n", "1" for namespace specific features
+func getFeature(runner commandRunner, device string, fid int, sel int, args ...string) (uint64, error) {
+	output, err := getFeatureOutput(runner, device, fid, sel, args...)
+	if err != nil {
+		return 0, err
+	}
+	return parseFeatureValue(output)
+}
+
+func getFeatureOutput(runner commandRunner, device string, fid int, sel int, args ...string) ([]byte, error) {
+	args = append([]string{"get-feature", device, "-f", strconv.Itoa(fid), "-s", strconv.Itoa(sel)}, args...)
+	return runNvme(runner, args...)
+}
+
+func parseFeatureValue(output []byte) (uint64, error) {
+	m := featureValueRegexp.FindSubmatch(output)
+	if m == nil {
+		return 0, fmt.Errorf("no feature value in get-feature output %q", output)
+	}
+	return strconv.ParseUint(string(m[1]), 0, 32)
+}
+
+// parseNumberOfQueues decodes the Number of Queues feature (0x07) into the
+// number of I/O queue pairs. NSQA and NCQA are 0's based counts of
+// submission and completion queues, usable pairs are bound by the smaller.
+func parseNumberOfQueues(value uint64) float64 {
+	submission := value & 0xffff
+	completion := value >> 16 & 0xffff
+	if completion < submission {
+		return float64(completion + 1)
+	}
+	return float64(submission + 1)
+}
+
+// parseHostMemoryBuffer returns whether the host memory buffer is enabled
+// and its size in bytes from human readable get-feature 0x0D output
+func parseHostMemoryBuffer(output []byte) (bool, float64, error) {
+	value, err := parseFeatureValue(output)
+	if err != nil {
+		return false, 0, err
+	}
+	// bit 0 is enable host memory (EHM)
+	enabled := value&1 == 1
+	m := hmbSizeRegexp.FindSubmatch(output)
+	if m == nil {
+		return enabled, 0, nil
+	}
+	pages, err := strconv.ParseUint(string(m[1]), 10, 32)
+	if err != nil {
+		return enabled, 0, err
+	}
+	return enabled, float64(pages * hmbPageSize), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseNumberOfQueues(t *testing.T) {
+	tests := []struct {
+		output string
+		want   float64
+	}{
+		{"get-feature:0x07 (Number of Queues), Current value:0x003f003f", 64},
+		// fewer completion than submission queues bound the pairs
+		{"get-feature:0x07 (Number of Queues), Current value:0x001f003f", 32},
+		{"get-feature:0x07 (Number of Queues), Current value:0x00000000", 1},
+		{"get-feature:0x7 (Number of Queues), Current value: 0x00ff00ff\n", 256},
+	}
+	for _, test := range tests {
+		value, err := parseFeatureValue([]byte(test.output))
+		if err != nil {
+			t.Errorf("parseFeatureValue(%q): unexpected error: %s", test.output, err)
+			continue
+		}
+		if got := parseNumberOfQueues(value); got != test.want {
+			t.Errorf("parseNumberOfQueues(%q) = %v, want %v", test.output, got, test.want)
+		}
+	}
+	if _, err := parseFeatureValue([]byte("NVMe status: Invalid Field in Command")); err == nil {
+		t.Errorf("parseFeatureValue() of an error message: expected an error")
+	}
+}
+
+func TestCollectNumberOfQueues(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":                             testNvmeList,
+		"id-ctrl":                          testIdCtrl,
+		"smart-log":                        testSmartLog,
+		"get-feature /dev/nvme0 -f 7 -s 1": "get-feature:0x07 (Number of Queues), Current value:0x003f003f",
+		"get-feature /dev/nvme0 -f 7 -s 0": "get-feature:0x07 (Number of Queues), Current value:0x00070007",
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_controller_max_io_queues"]; ok {
+		t.Errorf("nvme_controller_max_io_queues exported without collect-queues")
+	}
+	config := testCollectorConfig(runner)
+	config.collectQueues = true
+	families = gatherMetrics(t, newNvmeCollector(config))
+	if got, _ := metricValue(families, "nvme_controller_max_io_queues", "controller", "nvme0"); got != 64 {
+		t.Errorf("nvme_controller_max_io_queues = %v, want 64 from the default value", got)
+	}
+	if got, _ := metricValue(families, "nvme_controller_current_io_queues", "controller", "nvme0"); got != 8 {
+		t.Errorf("nvme_controller_current_io_queues = %v, want 8 from the current value", got)
+	}
+}
+
+func TestCollectVolatileWriteCache(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":                             testNvmeList,
+		"id-ctrl":                          `{"sn": "S123", "vwc": 1}`,
+		"smart-log":                        testSmartLog,
+		"get-feature /dev/nvme0 -f 6 -s 0": "get-feature:0x06 (Volatile Write Cache), Current value:0x00000001",
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_volatile_write_cache_enabled"]; ok {
+		t.Errorf("nvme_volatile_write_cache_enabled exported without collect-volatile-write-cache")
+	}
+	config := testCollectorConfig(runner)
+	config.collectVolatileWriteCache = true
+	families = gatherMetrics(t, newNvmeCollector(config))
+	if got, ok := metricValue(families, "nvme_volatile_write_cache_enabled", "controller", "nvme0"); !ok || got != 1 {
+		t.Errorf("nvme_volatile_write_cache_enabled = %v, %v, want 1", got, ok)
+	}
+}
+
+func TestFeatureUnsupportedLoggedOnce(t *testing.T) {
+	useTestSysfs(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	// get-feature isn't in the runner, so it fails like an unsupported feature
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   `{"sn": "S123", "vwc": 1}`,
+		"smart-log": testSmartLog,
+	})
+	config.collectVolatileWriteCache = true
+	collector := newNvmeCollector(config)
+	for i := 0; i < 3; i++ {
+		families := gatherMetrics(t, collector)
+		if _, ok := families["nvme_volatile_write_cache_enabled"]; ok {
+			t.Errorf("scrape %d: nvme_volatile_write_cache_enabled exported for an unsupported feature", i)
+		}
+	}
+	if n := strings.Count(buf.String(), "Skipping volatile write cache for controller nvme0"); n != 1 {
+		t.Errorf("unsupported volatile write cache logged %d times in 3 scrapes, want once:\n%s", n, buf.String())
+	}
+}
+
+func TestParseHostMemoryBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		enabled bool
+		size    float64
+	}{
+		{"enabled", "get-feature:0xd (Host Memory Buffer), Current value:0x000001\n\tEnable Host Memory (EHM): Enabled\n\tHost Memory Descriptor List Entry Count (HMDLEC): 8\n\tHost Memory Buffer Size (HSIZE): 8192\n", true, 8192 * 4096},
+		{"disabled", "get-feature:0xd (Host Memory Buffer), Current value:0x000000\n\tEnable Host Memory (EHM): Disabled\n\tHost Memory Buffer Size (HSIZE): 0\n", false, 0},
+		{"without details", "get-feature:0xd (Host Memory Buffer), Current value:0x000001", true, 0},
+	}
+	for _, test := range tests {
+		enabled, size, err := parseHostMemoryBuffer([]byte(test.output))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if enabled != test.enabled || size != test.size {
+			t.Errorf("%s: parseHostMemoryBuffer() = %v, %v, want %v, %v", test.name, enabled, size, test.enabled, test.size)
+		}
+	}
+}
+
+func TestCollectHostMemoryBuffer(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":                                 testNvmeList,
+		"id-ctrl":                              `{"sn": "S123", "hmpre": 8192}`,
+		"smart-log":                            testSmartLog,
+		"get-feature /dev/nvme0 -f 13 -s 0 -H": "get-feature:0xd (Host Memory Buffer), Current value:0x000001\n\tHost Memory Buffer Size (HSIZE): 16\n",
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_hmb_enabled"]; ok {
+		t.Errorf("nvme_hmb_enabled exported without collect-host-memory-buffer")
+	}
+	config := testCollectorConfig(runner)
+	config.collectHostMemoryBuffer = true
+	families = gatherMetrics(t, newNvmeCollector(config))
+	if got, ok := metricValue(families, "nvme_hmb_enabled", "controller", "nvme0"); !ok || got != 1 {
+		t.Errorf("nvme_hmb_enabled = %v, %v, want 1", got, ok)
+	}
+	if got, ok := metricValue(families, "nvme_hmb_size_bytes", "controller", "nvme0"); !ok || got != 16*4096 {
+		t.Errorf("nvme_hmb_size_bytes = %v, %v, want %v", got, ok, 16*4096)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// Run against a fixture directory instead of real drives, for integration
+// tests in CI
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// useFixtureDir runs the nvme found in dir/bin instead of the system
+// nvme-cli, and reads sysfs attributes from dir/sys. The stub nvme prints
+// canned output for each subcommand.
+func useFixtureDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin", "nvme")); err != nil {
+		return err
+	}
+	if err := os.Setenv("PATH", filepath.Join(dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH")); err != nil {
+		return err
+	}
+	sysClassNvme = filepath.Join(dir, "sys", "class", "nvme")
+	sysBlock = filepath.Join(dir, "sys", "block")
+	return nil
+}
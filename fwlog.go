@@ -0,0 +1,85 @@
+package main
+
+// Export the firmware revision of each slot from the nvme firmware slot log
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// fw-log keys the revisions by slot, e.g.
+// "Firmware Rev Slot 1": "3472328296227680304 (GPJA0B3Q)"
+var firmwareSlotRegexp = regexp.MustCompile(`^Firmware Rev Slot (\d+)$`)
+
+type firmwareLogCollector struct {
+	nvmeFirmwareSlotInfo   *prometheus.Desc
+	nvmeFirmwareActiveSlot *prometheus.Desc
+	runner                 commandRunner
+}
+
+func newFirmwareLogCollector(runner commandRunner) *firmwareLogCollector {
+	return &firmwareLogCollector{
+		nvmeFirmwareSlotInfo: prometheus.NewDesc(
+			metricName("firmware_slot_info"),
+			"Firmware revision stored in each firmware slot of the controller, always 1",
+			[]string{"controller", "slot", "revision"},
+			nil,
+		),
+		nvmeFirmwareActiveSlot: prometheus.NewDesc(
+			metricName("firmware_active_slot"),
+			"Firmware slot the running firmware was activated from (afi bits 2:0)",
+			controllerLabels,
+			nil,
+		),
+		runner: runner,
+	}
+}
+
+func (c *firmwareLogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeFirmwareSlotInfo
+	ch <- c.nvmeFirmwareActiveSlot
+}
+
+func (c *firmwareLogCollector) collect(ch chan<- prometheus.Metric, controller string) {
+	nvmeFwLog, err := runNvmeJSON(c.runner, "fw-log", "/dev/"+controller, "-o", "json")
+	if err != nil {
+		warnf("Skipping fw-log metrics for controller %s: %s\n", controller, err)
+		return
+	}
+	if !gjson.ValidBytes(nvmeFwLog) {
+		warnf("Skipping fw-log metrics for controller %s: fw-log json is not valid\n", controller)
+		return
+	}
+	// the log is nested under the device name
+	fwLog := gjson.ParseBytes(nvmeFwLog)
+	if device := fwLog.Get(controller); device.IsObject() {
+		fwLog = device
+	}
+	fwLog.ForEach(func(key, value gjson.Result) bool {
+		if key.String() == "Active Firmware Slot (afi)" {
+			ch <- prometheus.MustNewConstMetric(c.nvmeFirmwareActiveSlot, prometheus.GaugeValue, float64(value.Uint()&0x7), controller)
+			return true
+		}
+		m := firmwareSlotRegexp.FindStringSubmatch(key.String())
+		if m == nil {
+			return true
+		}
+		// unused slots are empty or 0
+		if revision := firmwareRevision(value.String()); revision != "" && revision != "0" {
+			ch <- prometheus.MustNewConstMetric(c.nvmeFirmwareSlotInfo, prometheus.GaugeValue, 1, controller, m[1], revision)
+		}
+		return true
+	})
+}
+
+// firmwareRevision returns the ASCII revision nvme-cli prints in
+// parentheses after the raw 64-bit value, or the value as is
+func firmwareRevision(value string) string {
+	if start, end := strings.Index(value, "("), strings.LastIndex(value, ")"); start >= 0 && end > start {
+		return strings.TrimSpace(value[start+1 : end])
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,43 @@
+package main
+
+// Guard against scraping drives more often than a minimum interval
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// minIntervalGatherer serves the previous gather result when asked again
+// within minInterval, instead of running the nvme commands again.
+// Concurrent requests wait for the gather in progress and share its result.
+type minIntervalGatherer struct {
+	gatherer    prometheus.Gatherer
+	minInterval time.Duration
+
+	mu             sync.Mutex
+	lastGather     time.Time
+	metricFamilies []*dto.MetricFamily
+	err            error
+}
+
+func newMinIntervalGatherer(gatherer prometheus.Gatherer, minInterval time.Duration) prometheus.Gatherer {
+	if minInterval <= 0 {
+		return gatherer
+	}
+	return &minIntervalGatherer{gatherer: gatherer, minInterval: minInterval}
+}
+
+func (g *minIntervalGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.lastGather.IsZero() && time.Since(g.lastGather) < g.minInterval {
+		debugf("Serving metrics gathered %s ago\n", time.Since(g.lastGather))
+		return g.metricFamilies, g.err
+	}
+	g.metricFamilies, g.err = g.gatherer.Gather()
+	g.lastGather = time.Now()
+	return g.metricFamilies, g.err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// countingGatherer counts the gathers that reach it
+func countingGatherer(count *int32) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		atomic.AddInt32(count, 1)
+		return nil, nil
+	})
+}
+
+func TestMinIntervalGatherer(t *testing.T) {
+	var count int32
+	gatherer := newMinIntervalGatherer(countingGatherer(&count), time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gatherer.Gather(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if count != 1 {
+		t.Errorf("two rapid requests gathered %d times, want once", count)
+	}
+}
+
+func TestMinIntervalGathererDisabled(t *testing.T) {
+	var count int32
+	gatherer := newMinIntervalGatherer(countingGatherer(&count), 0)
+	gatherer.Gather()
+	gatherer.Gather()
+	if count != 2 {
+		t.Errorf("gathered %d times without min-scrape-interval, want 2", count)
+	}
+}
@@ -4,5 +4,7 @@ go 1.16
 
 require (
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
 	github.com/tidwall/gjson v1.8.1
 )
@@ -0,0 +1,121 @@
+package main
+
+// Derive a 0-100 drive health score from smart-log values
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// health score factors saturate at these values
+const (
+	// minutes above the warning temperature, critical minutes count double
+	healthScoreTemperatureMinutes = 24 * 60
+	healthScoreMediaErrors        = 10
+)
+
+// healthScoreWeights is the maximum number of points each factor deducts
+// from a score of 100
+type healthScoreWeights struct {
+	Spare       float64 `json:"spare"`
+	Wear        float64 `json:"wear"`
+	Temperature float64 `json:"temperature"`
+	MediaErrors float64 `json:"media_errors"`
+}
+
+func defaultHealthScoreWeights() healthScoreWeights {
+	return healthScoreWeights{Spare: 30, Wear: 30, Temperature: 15, MediaErrors: 25}
+}
+
+// loadHealthScoreWeights reads weights from a json object, weights missing
+// from the file keep their default
+func loadHealthScoreWeights(path string) (healthScoreWeights, error) {
+	weights := defaultHealthScoreWeights()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return weights, err
+	}
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return weights, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	if err := weights.validate(); err != nil {
+		return weights, fmt.Errorf("invalid weights in %s: %s", path, err)
+	}
+	return weights, nil
+}
+
+// validate rejects negative weights, which would raise the score of
+// unhealthy drives, and weights that are all 0
+func (w healthScoreWeights) validate() error {
+	factors := []struct {
+		name   string
+		weight float64
+	}{
+		{"spare", w.Spare},
+		{"wear", w.Wear},
+		{"temperature", w.Temperature},
+		{"media_errors", w.MediaErrors},
+	}
+	sum := 0.0
+	for _, factor := range factors {
+		if factor.weight < 0 {
+			return fmt.Errorf("weight of %s is negative", factor.name)
+		}
+		sum += factor.weight
+	}
+	if sum <= 0 {
+		return fmt.Errorf("weights must sum to more than 0")
+	}
+	return nil
+}
+
+// score deducts each weight scaled by a factor between 0 and 1:
+//   - spare: how far avail_spare has dropped from 100 towards spare_thresh
+//   - wear: percent_used
+//   - temperature: warning_temp_time plus twice critical_comp_time, out of a day
+//   - media errors: growth of media_errors, see mediaErrorTracker, out of 10
+func (w healthScoreWeights) score(availSpare, spareThresh, percentUsed, warningTempTime, criticalCompTime, mediaErrorGrowth float64) float64 {
+	spare := 1.0
+	if availSpare > spareThresh {
+		spare = (100 - availSpare) / (100 - spareThresh)
+	}
+	score := 100 -
+		w.Spare*clampRatio(spare) -
+		w.Wear*clampRatio(percentUsed/100) -
+		w.Temperature*clampRatio((warningTempTime+2*criticalCompTime)/healthScoreTemperatureMinutes) -
+		w.MediaErrors*clampRatio(mediaErrorGrowth/healthScoreMediaErrors)
+	return math.Max(0, math.Min(100, score))
+}
+
+// mediaErrorTracker tracks the growth of media_errors of each device since
+// the exporter first collected it, so the score reflects new errors rather
+// than errors the drive logged before it was deployed
+type mediaErrorTracker struct {
+	mu        sync.Mutex
+	baselines map[string]float64
+}
+
+func newMediaErrorTracker() *mediaErrorTracker {
+	return &mediaErrorTracker{baselines: make(map[string]float64)}
+}
+
+// growth returns the media errors of the device since its baseline. A
+// counter lower than the baseline, e.g. after a drive replacement, becomes
+// the new baseline.
+func (t *mediaErrorTracker) growth(nvmeDevice string, mediaErrors float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	baseline, ok := t.baselines[nvmeDevice]
+	if !ok || mediaErrors < baseline {
+		t.baselines[nvmeDevice] = mediaErrors
+		return 0
+	}
+	return mediaErrors - baseline
+}
+
+func clampRatio(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
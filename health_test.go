@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthScore(t *testing.T) {
+	weights := defaultHealthScoreWeights()
+	tests := []struct {
+		name                                                string
+		availSpare, spareThresh, percentUsed                float64
+		warningTempTime, criticalCompTime, mediaErrorGrowth float64
+		want                                                float64
+	}{
+		{"healthy", 100, 10, 0, 0, 0, 0, 100},
+		{"half the spare used", 55, 10, 0, 0, 0, 0, 85},
+		{"spare below threshold", 5, 10, 0, 0, 0, 0, 70},
+		{"half worn", 100, 10, 50, 0, 0, 0, 85},
+		{"worn past 100 percent", 100, 10, 120, 0, 0, 0, 70},
+		{"half a day over warning temperature", 100, 10, 0, 720, 0, 0, 92.5},
+		{"critical temperature counts double", 100, 10, 0, 0, 720, 0, 85},
+		{"new media errors", 100, 10, 0, 0, 0, 5, 87.5},
+		{"everything failing", 5, 10, 120, 2000, 2000, 20, 0},
+	}
+	for _, test := range tests {
+		got := weights.score(test.availSpare, test.spareThresh, test.percentUsed, test.warningTempTime, test.criticalCompTime, test.mediaErrorGrowth)
+		if got != test.want {
+			t.Errorf("%s: score = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMediaErrorTracker(t *testing.T) {
+	tracker := newMediaErrorTracker()
+	tests := []struct {
+		device      string
+		mediaErrors float64
+		want        float64
+	}{
+		// errors from before the first collection are the baseline
+		{"/dev/nvme0n1", 40, 0},
+		{"/dev/nvme0n1", 43, 3},
+		{"/dev/nvme1n1", 2, 0},
+		{"/dev/nvme0n1", 45, 5},
+		// a replaced drive starts over
+		{"/dev/nvme0n1", 1, 0},
+		{"/dev/nvme0n1", 2, 1},
+	}
+	for i, test := range tests {
+		if got := tracker.growth(test.device, test.mediaErrors); got != test.want {
+			t.Errorf("collection %d: growth(%s, %v) = %v, want %v", i, test.device, test.mediaErrors, got, test.want)
+		}
+	}
+}
+
+func TestLoadHealthScoreWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    healthScoreWeights
+		wantErr bool
+	}{
+		{"partial", `{"spare": 40, "media_errors": 35}`, healthScoreWeights{Spare: 40, Wear: 30, Temperature: 15, MediaErrors: 35}, false},
+		{"single factor", `{"spare": 0, "wear": 0, "temperature": 0, "media_errors": 100}`, healthScoreWeights{MediaErrors: 100}, false},
+		{"negative", `{"wear": -10}`, healthScoreWeights{}, true},
+		{"all zero", `{"spare": 0, "wear": 0, "temperature": 0, "media_errors": 0}`, healthScoreWeights{}, true},
+		{"invalid json", `{"spare": }`, healthScoreWeights{}, true},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "weights.json")
+		if err := ioutil.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadHealthScoreWeights(path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: weights = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
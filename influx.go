@@ -0,0 +1,133 @@
+package main
+
+// Render gathered metrics as InfluxDB line protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// metricsHandler serves the Prometheus exposition format, or InfluxDB line
+// protocol when requested with ?format=influx
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	// promhttp negotiates gzip compression itself
+	promHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "influx" {
+			promHandler.ServeHTTP(w, r)
+			return
+		}
+		metricFamilies, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, "Error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !gzipAccepted(r) {
+			writeInfluxLineProtocol(w, metricFamilies, time.Now())
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		writeInfluxLineProtocol(gz, metricFamilies, time.Now())
+	})
+}
+
+// gzipAccepted reports whether the request's Accept-Encoding allows gzip
+func gzipAccepted(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding == "gzip" || strings.HasPrefix(encoding, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeInfluxLineProtocol writes one line per metric using the metric name
+// as measurement and the labels as tags. Counters, gauges and untyped
+// metrics have a single "value" field, summaries and histograms have sum and
+// count fields plus one field per quantile or bucket.
+func writeInfluxLineProtocol(w io.Writer, metricFamilies []*dto.MetricFamily, now time.Time) {
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			fields := make(map[string]float64)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				fields["value"] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				fields["value"] = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				fields["value"] = m.GetUntyped().GetValue()
+			case dto.MetricType_SUMMARY:
+				fields["sum"] = m.GetSummary().GetSampleSum()
+				fields["count"] = float64(m.GetSummary().GetSampleCount())
+				for _, q := range m.GetSummary().GetQuantile() {
+					fields[strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)] = q.GetValue()
+				}
+			case dto.MetricType_HISTOGRAM:
+				fields["sum"] = m.GetHistogram().GetSampleSum()
+				fields["count"] = float64(m.GetHistogram().GetSampleCount())
+				for _, b := range m.GetHistogram().GetBucket() {
+					fields[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = float64(b.GetCumulativeCount())
+				}
+			}
+			line := formatInfluxLine(mf.GetName(), m.GetLabel(), fields)
+			if line == "" {
+				continue
+			}
+			io.WriteString(w, line+" "+timestamp+"\n")
+		}
+	}
+}
+
+func formatInfluxLine(name string, labels []*dto.LabelPair, fields map[string]float64) string {
+	var b bytes.Buffer
+	b.WriteString(influxMeasurementEscaper.Replace(name))
+	for _, l := range labels {
+		// empty tag values are not allowed in line protocol
+		if l.GetValue() == "" {
+			continue
+		}
+		b.WriteString("," + influxTagEscaper.Replace(l.GetName()) + "=" + influxTagEscaper.Replace(l.GetValue()))
+	}
+	keys := make([]string, 0, len(fields))
+	for k, v := range fields {
+		// line protocol has no representation for NaN or infinity
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(influxTagEscaper.Replace(k) + "=" + strconv.FormatFloat(fields[k], 'g', -1, 64))
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func labelPairs(pairs ...string) []*dto.LabelPair {
+	var labels []*dto.LabelPair
+	for i := 0; i+1 < len(pairs); i += 2 {
+		name, value := pairs[i], pairs[i+1]
+		labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return labels
+}
+
+func TestFormatInfluxLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []*dto.LabelPair
+		fields map[string]float64
+		want   string
+	}{
+		{"nvme_temperature", labelPairs("device", "/dev/nvme0n1"), map[string]float64{"value": 36.85}, `nvme_temperature,device=/dev/nvme0n1 value=36.85`},
+		{"nvme_device_info", labelPairs("model", "Example NVMe, rev 2", "alias", ""), map[string]float64{"value": 1}, `nvme_device_info,model=Example\ NVMe\,\ rev\ 2 value=1`},
+		{"nvme_scrape_duration", nil, map[string]float64{"sum": 1.5, "count": 3, "0.5": 0.4}, `nvme_scrape_duration 0.5=0.4,count=3,sum=1.5`},
+		{"nvme_data_units_read", nil, map[string]float64{"value": 1e15}, `nvme_data_units_read value=1e+15`},
+		{"nvme_ratio", nil, map[string]float64{"value": math.NaN()}, ``},
+	}
+	for _, test := range tests {
+		if got := formatInfluxLine(test.name, test.labels, test.fields); got != test.want {
+			t.Errorf("formatInfluxLine(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteInfluxLineProtocol(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	temperature := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nvme_temperature", Help: "Test"}, labels)
+	temperature.WithLabelValues("/dev/nvme0n1").Set(36.85)
+	registry.MustRegister(temperature)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeInfluxLineProtocol(&buf, families, time.Unix(1600000000, 0))
+	if want := "nvme_temperature,device=/dev/nvme0n1 value=36.85 1600000000000000000\n"; buf.String() != want {
+		t.Errorf("line protocol = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestMetricsHandlerGzip(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	temperature := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nvme_temperature", Help: "Test"}, labels)
+	temperature.WithLabelValues("/dev/nvme0n1").Set(36.85)
+	registry.MustRegister(temperature)
+	handler := metricsHandler(registry)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/metrics", `nvme_temperature{device="/dev/nvme0n1"} 36.85`},
+		{"/metrics?format=influx", `nvme_temperature,device=/dev/nvme0n1 value=36.85`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Errorf("%s: Content-Encoding = %q, want gzip", test.url, encoding)
+			continue
+		}
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Errorf("%s: response isn't gzip compressed: %s", test.url, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Errorf("%s: error decompressing the response: %s", test.url, err)
+			continue
+		}
+		if !strings.Contains(string(body), test.want) {
+			t.Errorf("%s: decompressed response doesn't contain %q:\n%s", test.url, test.want, body)
+		}
+
+		// clients that don't accept gzip get plain text
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", test.url, nil))
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%s: Content-Encoding = %q without Accept-Encoding, want none", test.url, encoding)
+		}
+		if !strings.Contains(rec.Body.String(), test.want) {
+			t.Errorf("%s: response doesn't contain %q:\n%s", test.url, test.want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// startFixtureServer serves the exporter's /metrics handler collecting from
+// the fixture directory dir, like running it with --fixture-dir
+func startFixtureServer(t *testing.T, dir string, config collectorConfig) *httptest.Server {
+	t.Helper()
+	oldPath, oldSysClassNvme, oldSysBlock := os.Getenv("PATH"), sysClassNvme, sysBlock
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		sysClassNvme, sysBlock = oldSysClassNvme, oldSysBlock
+	})
+	if err := useFixtureDir(dir); err != nil {
+		t.Fatalf("error using fixture dir %s: %s", dir, err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newNvmeCollector(config))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(registry))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// scrapeMetrics scrapes /metrics from server and parses the exposition
+// format with the Prometheus text parser
+func scrapeMetrics(t *testing.T, server *httptest.Server) map[string]*dto.MetricFamily {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("error scraping metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scraping metrics returned %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("error parsing metrics: %s", err)
+	}
+	return families
+}
+
+func TestIntegrationFixtureDir(t *testing.T) {
+	server := startFixtureServer(t, "testdata/fixtures", testCollectorConfig(nil))
+	families := scrapeMetrics(t, server)
+	device := []string{"device", "/dev/nvme0n1"}
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"nvme_up", nil, 1},
+		{"nvme_temperature", device, 34.85},
+		{"nvme_temperature_sensor1", device, 34.85},
+		{"nvme_temperature_sensor2", device, 37.85},
+		{"nvme_avail_spare", device, 100},
+		{"nvme_percent_used", device, 2},
+		{"nvme_data_units_read", device, 12345},
+		{"nvme_data_written_bytes_total", device, 67890 * dataUnitBytes},
+		{"nvme_power_on_hours", device, 5000},
+		{"nvme_unsafe_shutdowns", device, 3},
+		{"nvme_critical_temperature_threshold", device, 84.85},
+		{"nvme_over_critical_temp", device, 0},
+		{"nvme_total_capacity", []string{"controller", "nvme0"}, 1000204886016},
+		{"nvme_device_info", []string{"device", "/dev/nvme0n1", "wwid", "eui.0000000000000000000000000000abcd", "model", "Fixture NVMe Drive", "serial", "FIXTURE0001", "firmware", "1.0.0"}, 1},
+		{"nvme_device_format_branch", []string{"device", "/dev/nvme0n1", "branch", "namespaces"}, 1},
+	}
+	for _, test := range tests {
+		got, ok := metricValue(families, test.name, test.labels...)
+		if !ok {
+			t.Errorf("%s%v is missing", test.name, test.labels)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// Serve an index page at / linking to the metrics
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func landingHandler(temperatureScale string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html>
+<head><title>NVMe Exporter</title></head>
+<body>
+<h1>NVMe Exporter</h1>
+<p>Version: %s</p>
+<p>Temperature scale: %s</p>
+<p><a href="/metrics">Metrics</a></p>
+</body>
+</html>
+`, html.EscapeString(version), html.EscapeString(temperatureScale))
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+// Leveled wrappers around the standard logger
+
+import (
+	"fmt"
+	"log"
+)
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var currentLogLevel = logLevelInfo
+
+func parseLogLevel(level string) (logLevel, error) {
+	switch level {
+	case "debug":
+		return logLevelDebug, nil
+	case "info":
+		return logLevelInfo, nil
+	case "warn":
+		return logLevelWarn, nil
+	case "error":
+		return logLevelError, nil
+	}
+	return logLevelInfo, fmt.Errorf("unknown log level %q", level)
+}
+
+func debugf(format string, v ...interface{}) {
+	if currentLogLevel <= logLevelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func infof(format string, v ...interface{}) {
+	if currentLogLevel <= logLevelInfo {
+		log.Printf(format, v...)
+	}
+}
+
+// warnf is used for per-scrape problems that don't stop collection
+func warnf(format string, v ...interface{}) {
+	if currentLogLevel <= logLevelWarn {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	oldLevel := currentLogLevel
+	defer func() {
+		log.SetOutput(os.Stderr)
+		currentLogLevel = oldLevel
+	}()
+	tests := []struct {
+		level             string
+		debug, info, warn bool
+	}{
+		{"debug", true, true, true},
+		{"info", false, true, true},
+		{"warn", false, false, true},
+		// --quiet is the error level
+		{"error", false, false, false},
+	}
+	for _, test := range tests {
+		level, err := parseLogLevel(test.level)
+		if err != nil {
+			t.Fatalf("parseLogLevel(%q): unexpected error: %s", test.level, err)
+		}
+		currentLogLevel = level
+		for _, logged := range []struct {
+			logf func(string, ...interface{})
+			want bool
+		}{
+			{debugf, test.debug},
+			{infof, test.info},
+			{warnf, test.warn},
+		} {
+			buf.Reset()
+			logged.logf("message\n")
+			if got := buf.Len() > 0; got != logged.want {
+				t.Errorf("level %s: logged = %v, want %v", test.level, got, logged.want)
+			}
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("parseLogLevel(\"verbose\"): expected an error")
+	}
+}
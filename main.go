@@ -3,18 +3,134 @@ package main
 // Export nvme smart-log metrics in prometheus format
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
-	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tidwall/gjson"
 )
 
 var labels = []string{"device"}
+var controllerLabels = []string{"controller"}
+
+// metricPrefix is the first component of every metric name, set with
+// --metric-prefix
+var metricPrefix = "nvme"
+
+var metricPrefixRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func metricName(name string) string {
+	return metricPrefix + "_" + name
+}
+
+type collectorConfig struct {
+	collectOCP                  bool
+	collectErrorLog             bool
+	collectNamespace            bool
+	verboseHelp                 bool
+	smartLogNsid                string
+	trackCounterResets          bool
+	maxDevices                  int
+	temperatureScale            string
+	listNsFallback              bool
+	collectNamespaceControllers bool
+	collectReservations         bool
+	maxTempSensors              int
+	extraCollectors             []*extraCollector
+	collectPersistentEventLog   bool
+	compositeAsSensor0          bool
+	deviceAliases               map[string]string
+	smartOnly                   bool
+	adaptiveMaxInterval         time.Duration
+	healthScoreWeights          *healthScoreWeights
+	deviceLabel                 string
+	collectPowerStates          bool
+	collectQueues               bool
+	collectVolatileWriteCache   bool
+	collectHostMemoryBuffer     bool
+	collectEndurance            bool
+	cacheTTL                    time.Duration
+	concurrency                 int
+	collectFirmwareLog          bool
+	maxErrorLogEntries          int
+	deviceFilter                *deviceFilter
+	alwaysEmit                  bool
+	runner                      commandRunner
+	listLayout                  string
+}
+
+// smartLogOnly disables every metric group except smart-log
+func (config collectorConfig) smartLogOnly() collectorConfig {
+	config.smartOnly = true
+	config.collectOCP = false
+	config.collectErrorLog = false
+	config.collectNamespace = false
+	config.listNsFallback = false
+	config.collectNamespaceControllers = false
+	config.collectReservations = false
+	config.extraCollectors = nil
+	config.collectPersistentEventLog = false
+	config.collectPowerStates = false
+	config.collectQueues = false
+	config.collectVolatileWriteCache = false
+	config.collectHostMemoryBuffer = false
+	config.collectFirmwareLog = false
+	config.collectEndurance = false
+	return config
+}
+
+// collectors returns whether each metric group is enabled
+func (config collectorConfig) collectors() map[string]bool {
+	collectors := map[string]bool{
+		"smart_log":             true,
+		"ocp":                   config.collectOCP,
+		"error_log":             config.collectErrorLog,
+		"persistent_event_log":  config.collectPersistentEventLog,
+		"namespace":             config.collectNamespace,
+		"counter_resets":        config.trackCounterResets,
+		"namespace_controllers": config.collectNamespaceControllers,
+		"reservations":          config.collectReservations,
+		"power_states":          config.collectPowerStates,
+		"queues":                config.collectQueues,
+		"volatile_write_cache":  config.collectVolatileWriteCache,
+		"host_memory_buffer":    config.collectHostMemoryBuffer,
+		"firmware_log":          config.collectFirmwareLog,
+		"endurance":             config.collectEndurance,
+	}
+	for _, extra := range config.extraCollectors {
+		collectors["extra_"+extra.name] = true
+	}
+	return collectors
+}
+
+// enabledCollectors returns the sorted names of the enabled metric groups
+func (config collectorConfig) enabledCollectors() []string {
+	var enabled []string
+	for name, ok := range config.collectors() {
+		if ok {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
 
 type nvmeCollector struct {
 	nvmeCriticalWarning *prometheus.Desc
@@ -39,146 +155,642 @@ type nvmeCollector struct {
 	nvmeThmTemp2TransCount *prometheus.Desc
 	nvmeThmTemp1TotalTime *prometheus.Desc
 	nvmeThmTemp2TotalTime *prometheus.Desc
+	nvmeDiscoveryControllerUp *prometheus.Desc
+	nvmeFabricConnectionInfo *prometheus.Desc
+	nvmeAnaState *prometheus.Desc
+	nvmeDataReadBytes *prometheus.Desc
+	nvmeDataWrittenBytes *prometheus.Desc
+	nvmeHostDataReadBytes *prometheus.Desc
+	nvmeHostDataWrittenBytes *prometheus.Desc
+	nvmeHostAnyCriticalWarning *prometheus.Desc
+	nvmeCliBannerDetected *prometheus.Desc
+	nvmeCollectWorkers *prometheus.Desc
+	nvmeCollectQueueDepth *prometheus.Desc
+	nvmeErrorLogCapacity *prometheus.Desc
+	nvmeInflightCommands *prometheus.Desc
+	nvmeCounterResets *prometheus.Desc
+	nvmeDevicesSkipped *prometheus.Desc
+	nvmeNamespaceCount *prometheus.Desc
+	nvmeUp *prometheus.Desc
+	nvmeScrapeDuration *prometheus.Desc
+	nvmeCollectorErrors *prometheus.Desc
+	nvmeOverCriticalTemp *prometheus.Desc
+	nvmeCollectorEnabled *prometheus.Desc
+	nvmeWarningTempThreshold *prometheus.Desc
+	nvmeCriticalTempThreshold *prometheus.Desc
+	nvmeTotalCapacity *prometheus.Desc
+	nvmeFirmwareActivateNoReset *prometheus.Desc
+	nvmeFirmwareSlots *prometheus.Desc
+	nvmeMaxIOQueues *prometheus.Desc
+	nvmeRtd3EntryLatency *prometheus.Desc
+	nvmeRtd3ExitLatency *prometheus.Desc
+	nvmePowerStateMaxPower *prometheus.Desc
+	nvmeCurrentIOQueues *prometheus.Desc
+	nvmeVolatileWriteCacheEnabled *prometheus.Desc
+	nvmeHmbEnabled *prometheus.Desc
+	nvmeHmbSize *prometheus.Desc
+	nvmeTemperatureSensors []*prometheus.Desc
+	nvmeTemperatureSensor0 *prometheus.Desc
+	nvmeReadonly *prometheus.Desc
+	nvmeReliabilityDegraded *prometheus.Desc
+	nvmeAvailSpareBelowThreshold *prometheus.Desc
+	nvmeTempThresholdExceeded *prometheus.Desc
+	nvmeVmbuFailed *prometheus.Desc
+	nvmePmrReadonly *prometheus.Desc
+	nvmeDeviceInfo *prometheus.Desc
+	nvmeDriveLocked *prometheus.Desc
+	nvmeDeviceFormatBranch *prometheus.Desc
+	nvmeDriveHealthScore *prometheus.Desc
+	ocp *ocpCollector
+	errorLog *errorLogCollector
+	firmwareLog *firmwareLogCollector
+	endurance *enduranceCollector
+	persistentEventLog *persistentEventLogCollector
+	namespace *namespaceCollector
+	namespaceControllers *namespaceControllersCollector
+	reservations *reservationCollector
+	extraCollectors []*extraCollector
+	counterResets *counterResetTracker
+	deviceFilter *deviceFilter
+	adaptive *adaptiveSampler
+	cache *collectCache
+	availability *availabilityMarkers
+	healthScoreWeights *healthScoreWeights
+	mediaErrors *mediaErrorTracker
+	smartLogNsid string
+	maxDevices int
+	concurrency int
+	collectors map[string]bool
+	temperatureScale string
+	listNsFallback bool
+	deviceAliases map[string]string
+	smartOnly bool
+	collectQueues bool
+	collectVolatileWriteCache bool
+	collectHostMemoryBuffer bool
+	deviceLabel string
+	listLayout string
+	runner commandRunner
+	banners *bannerRunner
+	mu sync.Mutex
+	unsupportedFeatures map[string]bool
+	devicesSkipped float64
+	collectorErrors map[string]float64
 }
 
+// values of --device-label
+const (
+	deviceLabelNamespace  = "namespace"
+	deviceLabelController = "controller"
+)
+
+// data units are reported in thousands of 512 byte units
+const dataUnitBytes = 512 * 1000
+
 // nvme smart-log field descriptions can be found on page 180 of:
 // https://nvmexpress.org/wp-content/uploads/NVM-Express-Base-Specification-2_0-2021.06.02-Ratified-5.pdf
+const smartLogSpecReference = "(NVMe Base Specification 2.0, section 5.16.1.3 SMART / Health Information, page 180)"
 
-func newNvmeCollector() prometheus.Collector {
-	return &nvmeCollector{
+func newNvmeCollector(config collectorConfig) prometheus.Collector {
+	// with --verbose-help the spec reference is appended to smart-log help text
+	smartLogHelp := func(help string) string {
+		if config.verboseHelp {
+			return help + " " + smartLogSpecReference
+		}
+		return help
+	}
+	c := &nvmeCollector{
 		nvmeCriticalWarning: prometheus.NewDesc(
-			"nvme_critical_warning",
-			"Critical warnings for the state of the controller",
+			metricName("critical_warning"),
+			smartLogHelp("Critical warnings for the state of the controller"),
 			labels,
 			nil,
 		),
 		nvmeTemperature: prometheus.NewDesc(
-			"nvme_temperature",
-			"Temperature in degrees fahrenheit",
+			metricName("temperature"),
+			smartLogHelp("Temperature in "+temperatureUnit(config.temperatureScale)),
 			labels,
 			nil,
 		),
 		nvmeAvailSpare: prometheus.NewDesc(
-			"nvme_avail_spare",
-			"Normalized percentage of remaining spare capacity available",
+			metricName("avail_spare"),
+			smartLogHelp("Normalized percentage of remaining spare capacity available"),
 			labels,
 			nil,
 		),
 		nvmeSpareThresh: prometheus.NewDesc(
-			"nvme_spare_thresh",
-			"Async event completion may occur when avail spare < threshold",
+			metricName("spare_thresh"),
+			smartLogHelp("Async event completion may occur when avail spare < threshold"),
 			labels,
 			nil,
 		),
 		nvmePercentUsed: prometheus.NewDesc(
-			"nvme_percent_used",
-			"Vendor specific estimate of the percentage of life used",
+			metricName("percent_used"),
+			smartLogHelp("Vendor specific estimate of the percentage of life used"),
 			labels,
 			nil,
 		),
 		nvmeEnduranceGrpCriticalWarningSummary: prometheus.NewDesc(
-			"nvme_endurance_grp_critical_warning_summary",
-			"Critical warnings for the state of endurance groups",
+			metricName("endurance_grp_critical_warning_summary"),
+			smartLogHelp("Critical warnings for the state of endurance groups"),
 			labels,
 			nil,
 		),
 		nvmeDataUnitsRead: prometheus.NewDesc(
-			"nvme_data_units_read",
-			"Number of 512 byte data units host has read",
+			metricName("data_units_read"),
+			smartLogHelp("Number of 512 byte data units host has read"),
 			labels,
 			nil,
 		),
 		nvmeDataUnitsWritten: prometheus.NewDesc(
-			"nvme_data_units_written",
-			"Number of 512 byte data units the host has written",
+			metricName("data_units_written"),
+			smartLogHelp("Number of 512 byte data units the host has written"),
 			labels,
 			nil,
 		),
 		nvmeHostReadCommands: prometheus.NewDesc(
-			"nvme_host_read_commands",
-			"Number of read commands completed",
+			metricName("host_read_commands"),
+			smartLogHelp("Number of read commands completed"),
 			labels,
 			nil,
 		),
 		nvmeHostWriteCommands: prometheus.NewDesc(
-			"nvme_host_write_commands",
-			"Number of write commands completed",
+			metricName("host_write_commands"),
+			smartLogHelp("Number of write commands completed"),
 			labels,
 			nil,
 		),
 		nvmeControllerBusyTime: prometheus.NewDesc(
-			"nvme_controller_busy_time",
-			"Amount of time in minutes controller busy with IO commands",
+			metricName("controller_busy_time"),
+			smartLogHelp("Amount of time in minutes controller busy with IO commands"),
 			labels,
 			nil,
 		),
 		nvmePowerCycles: prometheus.NewDesc(
-			"nvme_power_cycles",
-			"Number of power cycles",
+			metricName("power_cycles"),
+			smartLogHelp("Number of power cycles"),
 			labels,
 			nil,
 		),
 		nvmePowerOnHours: prometheus.NewDesc(
-			"nvme_power_on_hours",
-			"Number of power on hours",
+			metricName("power_on_hours"),
+			smartLogHelp("Number of power on hours"),
 			labels,
 			nil,
 		),
 		nvmeUnsafeShutdowns: prometheus.NewDesc(
-			"nvme_unsafe_shutdowns",
-			"Number of unsafe shutdowns",
+			metricName("unsafe_shutdowns"),
+			smartLogHelp("Number of unsafe shutdowns"),
 			labels,
 			nil,
 		),
 		nvmeMediaErrors: prometheus.NewDesc(
-			"nvme_media_errors",
-			"Number of unrecovered data integrity errors",
+			metricName("media_errors"),
+			smartLogHelp("Number of unrecovered data integrity errors"),
 			labels,
 			nil,
 		),
 		nvmeNumErrLogEntries: prometheus.NewDesc(
-			"nvme_num_err_log_entries",
-			"Lifetime number of error log entries",
+			metricName("num_err_log_entries"),
+			smartLogHelp("Lifetime number of error log entries"),
 			labels,
 			nil,
 		),
 		nvmeWarningTempTime: prometheus.NewDesc(
-			"nvme_warning_temp_time",
-			"Amount of time in minutes temperature > warning threshold",
+			metricName("warning_temp_time"),
+			smartLogHelp("Amount of time in minutes temperature > warning threshold"),
 			labels,
 			nil,
 		),
 		nvmeCriticalCompTime: prometheus.NewDesc(
-			"nvme_critical_comp_time",
-			"Amount of time in minutes temperature > critical threshold",
+			metricName("critical_comp_time"),
+			smartLogHelp("Amount of time in minutes temperature > critical threshold"),
 			labels,
 			nil,
 		),
 		nvmeThmTemp1TransCount: prometheus.NewDesc(
-			"nvme_thm_temp1_trans_count",
-			"Number of times controller transitioned to lower power",
+			metricName("thm_temp1_trans_count"),
+			smartLogHelp("Number of times the controller transitioned to lower power for thermal management temperature 1"),
 			labels,
 			nil,
 		),
 		nvmeThmTemp2TransCount: prometheus.NewDesc(
-			"nvme_thm_temp2_trans_count",
-			"Number of times controller transitioned to lower power",
+			metricName("thm_temp2_trans_count"),
+			smartLogHelp("Number of times the controller transitioned to lower power for thermal management temperature 2"),
 			labels,
 			nil,
 		),
 		nvmeThmTemp1TotalTime: prometheus.NewDesc(
-			"nvme_thm_temp1_trans_time",
-			"Total number of seconds controller transitioned to lower power",
+			metricName("thm_temp1_trans_time"),
+			smartLogHelp("Total number of seconds the controller spent in lower power for thermal management temperature 1"),
 			labels,
 			nil,
 		),
 		nvmeThmTemp2TotalTime: prometheus.NewDesc(
-			"nvme_thm_temp2_trans_time",
-			"Total number of seconds controller transitioned to lower power",
+			metricName("thm_temp2_trans_time"),
+			smartLogHelp("Total number of seconds the controller spent in lower power for thermal management temperature 2"),
+			labels,
+			nil,
+		),
+		nvmeDiscoveryControllerUp: prometheus.NewDesc(
+			metricName("discovery_controller_up"),
+			"Whether an NVMe-oF discovery controller is live",
+			[]string{"controller", "address"},
+			nil,
+		),
+		nvmeDataReadBytes: prometheus.NewDesc(
+			metricName("data_read_bytes_total"),
+			smartLogHelp("Number of bytes read by the host, data_units_read in bytes"),
+			labels,
+			nil,
+		),
+		nvmeDataWrittenBytes: prometheus.NewDesc(
+			metricName("data_written_bytes_total"),
+			smartLogHelp("Number of bytes written by the host, data_units_written in bytes"),
+			labels,
+			nil,
+		),
+		nvmeHostDataReadBytes: prometheus.NewDesc(
+			metricName("host_data_read_bytes_total"),
+			"Number of bytes read by the host summed across all devices",
+			nil,
+			nil,
+		),
+		nvmeHostDataWrittenBytes: prometheus.NewDesc(
+			metricName("host_data_written_bytes_total"),
+			"Number of bytes written by the host summed across all devices",
+			nil,
+			nil,
+		),
+		nvmeCollectWorkers: prometheus.NewDesc(
+			metricName("collect_workers"),
+			"Maximum number of devices collected concurrently",
+			nil,
+			nil,
+		),
+		nvmeCollectQueueDepth: prometheus.NewDesc(
+			metricName("collect_queue_depth"),
+			"Largest number of devices waiting for a collection worker during the scrape",
+			nil,
+			nil,
+		),
+		nvmeCliBannerDetected: prometheus.NewDesc(
+			metricName("cli_banner_detected"),
+			"Whether nvme-cli printed a banner or warnings around its json output during the collection, which were stripped",
+			nil,
+			nil,
+		),
+		nvmeHostAnyCriticalWarning: prometheus.NewDesc(
+			metricName("host_any_critical_warning"),
+			"Whether any device on the host reports a non-zero critical_warning",
+			nil,
+			nil,
+		),
+		nvmeErrorLogCapacity: prometheus.NewDesc(
+			metricName("error_log_capacity"),
+			"Number of error log page entries supported by the controller",
+			controllerLabels,
+			nil,
+		),
+		nvmeInflightCommands: prometheus.NewDesc(
+			metricName("inflight_commands"),
+			"Number of I/O requests currently in flight",
+			labels,
+			nil,
+		),
+		nvmeCounterResets: prometheus.NewDesc(
+			metricName("counter_resets_total"),
+			"Number of scrapes where a smart-log counter decreased since the previous scrape",
+			labels,
+			nil,
+		),
+		nvmeCollectorErrors: prometheus.NewDesc(
+			metricName("collector_errors_total"),
+			"Number of failed smart-log collections of the device",
+			labels,
+			nil,
+		),
+		nvmeUp: prometheus.NewDesc(
+			metricName("up"),
+			"Whether nvme list succeeded and found devices in the last collection",
+			nil,
+			nil,
+		),
+		nvmeScrapeDuration: prometheus.NewDesc(
+			metricName("scrape_duration_seconds"),
+			"Duration of the last collection in seconds",
+			nil,
+			nil,
+		),
+		nvmeNamespaceCount: prometheus.NewDesc(
+			metricName("namespace_count"),
+			"Number of namespaces collected through the controller, multipath namespaces are counted once for the controller they are collected through",
+			controllerLabels,
+			nil,
+		),
+		nvmeDevicesSkipped: prometheus.NewDesc(
+			metricName("devices_skipped_total"),
+			"Number of devices not collected because of the max-devices limit",
+			nil,
+			nil,
+		),
+		nvmeOverCriticalTemp: prometheus.NewDesc(
+			metricName("over_critical_temp"),
+			"Whether the composite temperature is at or above the controller's critical composite temperature threshold (cctemp)",
+			labels,
+			nil,
+		),
+		nvmeCollectorEnabled: prometheus.NewDesc(
+			metricName("collector_enabled"),
+			"Whether a metric group is enabled",
+			[]string{"collector"},
+			nil,
+		),
+		nvmeWarningTempThreshold: prometheus.NewDesc(
+			metricName("warning_temperature_threshold"),
+			"Warning composite temperature threshold (wctemp) in "+temperatureUnit(config.temperatureScale),
+			labels,
+			nil,
+		),
+		nvmeCriticalTempThreshold: prometheus.NewDesc(
+			metricName("critical_temperature_threshold"),
+			"Critical composite temperature threshold (cctemp) in "+temperatureUnit(config.temperatureScale),
 			labels,
 			nil,
 		),
+		nvmeTotalCapacity: prometheus.NewDesc(
+			metricName("total_capacity"),
+			"Total NVM capacity of the controller in bytes",
+			controllerLabels,
+			nil,
+		),
+		nvmeFirmwareActivateNoReset: prometheus.NewDesc(
+			metricName("firmware_activate_no_reset"),
+			"Whether the controller supports firmware activation without a reset (frmw bit 4)",
+			controllerLabels,
+			nil,
+		),
+		nvmeFirmwareSlots: prometheus.NewDesc(
+			metricName("firmware_slots"),
+			"Number of firmware slots supported by the controller (frmw bits 3:1)",
+			controllerLabels,
+			nil,
+		),
+		nvmeRtd3EntryLatency: prometheus.NewDesc(
+			metricName("rtd3_entry_latency_us"),
+			"Expected latency in microseconds to enter runtime D3 (rtd3e), 0 if not reported",
+			controllerLabels,
+			nil,
+		),
+		nvmeRtd3ExitLatency: prometheus.NewDesc(
+			metricName("rtd3_exit_latency_us"),
+			"Expected latency in microseconds to resume from runtime D3 (rtd3r), 0 if not reported",
+			controllerLabels,
+			nil,
+		),
+		nvmeMaxIOQueues: prometheus.NewDesc(
+			metricName("controller_max_io_queues"),
+			"Maximum number of I/O queue pairs the controller allocates, the default value of the Number of Queues feature (get-feature 0x07 -s 1)",
+			controllerLabels,
+			nil,
+		),
+		nvmeVolatileWriteCacheEnabled: prometheus.NewDesc(
+			metricName("volatile_write_cache_enabled"),
+			"Whether the volatile write cache of the controller is enabled (get-feature 0x06), only reported for controllers with a volatile write cache",
+			controllerLabels,
+			nil,
+		),
+		nvmeHmbEnabled: prometheus.NewDesc(
+			metricName("hmb_enabled"),
+			"Whether the host memory buffer of the controller is enabled (get-feature 0x0D), only reported for controllers using a host memory buffer",
+			controllerLabels,
+			nil,
+		),
+		nvmeHmbSize: prometheus.NewDesc(
+			metricName("hmb_size_bytes"),
+			"Size of the host memory buffer allocated to the controller in bytes",
+			controllerLabels,
+			nil,
+		),
+		nvmeCurrentIOQueues: prometheus.NewDesc(
+			metricName("controller_current_io_queues"),
+			"Number of I/O queue pairs currently allocated by the controller, the current value of the Number of Queues feature (get-feature 0x07 -s 0)",
+			controllerLabels,
+			nil,
+		),
+		nvmeReadonly: prometheus.NewDesc(
+			metricName("readonly"),
+			smartLogHelp("Whether the media has been placed in read only mode (critical_warning bit 3)"),
+			labels,
+			nil,
+		),
+		nvmeReliabilityDegraded: prometheus.NewDesc(
+			metricName("reliability_degraded"),
+			smartLogHelp("Whether NVM subsystem reliability has been degraded due to media or internal errors (critical_warning bit 2)"),
+			labels,
+			nil,
+		),
+		nvmeAvailSpareBelowThreshold: prometheus.NewDesc(
+			metricName("avail_spare_below_threshold"),
+			smartLogHelp("Whether the available spare capacity has fallen below the threshold (critical_warning bit 0)"),
+			labels,
+			nil,
+		),
+		nvmeTempThresholdExceeded: prometheus.NewDesc(
+			metricName("temp_threshold_exceeded"),
+			smartLogHelp("Whether a temperature is above an over temperature or below an under temperature threshold (critical_warning bit 1)"),
+			labels,
+			nil,
+		),
+		nvmeVmbuFailed: prometheus.NewDesc(
+			metricName("vmbu_failed"),
+			smartLogHelp("Whether the volatile memory backup device has failed (critical_warning bit 4)"),
+			labels,
+			nil,
+		),
+		nvmePmrReadonly: prometheus.NewDesc(
+			metricName("pmr_readonly"),
+			smartLogHelp("Whether the persistent memory region has become read only or unreliable (critical_warning bit 5)"),
+			labels,
+			nil,
+		),
+		nvmeDeviceFormatBranch: prometheus.NewDesc(
+			metricName("device_format_branch"),
+			"Layout of the nvme list output the device was found in, one of namespaces, controllers or devicepaths, always 1",
+			[]string{"device", "branch"},
+			nil,
+		),
+		nvmeDriveLocked: prometheus.NewDesc(
+			metricName("drive_locked"),
+			"Whether smart-log was denied because the drive is locked, e.g. a self-encrypting drive that hasn't been unlocked",
+			labels,
+			nil,
+		),
+		nvmeFabricConnectionInfo: prometheus.NewDesc(
+			metricName("fabric_connection_info"),
+			"Transport and address of NVMe over Fabrics controllers, always 1",
+			[]string{"controller", "transport", "address"},
+			nil,
+		),
+		nvmeAnaState: prometheus.NewDesc(
+			metricName("ana_state"),
+			"Asymmetric namespace access state of each multipath path to the device, e.g. optimized, non-optimized or inaccessible, always 1",
+			[]string{"device", "controller", "path", "state"},
+			nil,
+		),
+		nvmeDeviceInfo: prometheus.NewDesc(
+			metricName("device_info"),
+			"Information about the device, always 1. alias is set from the device-alias-file, wwid identifies the namespace across device renumbering, model, serial and firmware are those of its controller",
+			[]string{"device", "alias", "wwid", "controller", "model", "serial", "firmware"},
+			nil,
+		),
+		maxDevices: config.maxDevices,
+		concurrency: config.concurrency,
+		collectors: config.collectors(),
+		temperatureScale: config.temperatureScale,
+		listNsFallback: config.listNsFallback,
+		deviceAliases: config.deviceAliases,
+		smartOnly: config.smartOnly,
+		collectQueues: config.collectQueues,
+		collectVolatileWriteCache: config.collectVolatileWriteCache,
+		collectHostMemoryBuffer: config.collectHostMemoryBuffer,
+		deviceLabel: config.deviceLabel,
+		listLayout: config.listLayout,
+		extraCollectors: config.extraCollectors,
+		deviceFilter: config.deviceFilter,
+		collectorErrors: make(map[string]float64),
+		unsupportedFeatures: make(map[string]bool),
+	}
+	// banners are reported per collection from the outputs of its commands
+	c.banners = &bannerRunner{commandRunner: config.runner}
+	if config.runner == nil {
+		c.banners.commandRunner = execRunner{}
+	}
+	c.runner = c.banners
+	// the spec defines 8 temperature sensors, some drives report more
+	for i := 1; i <= config.maxTempSensors; i++ {
+		c.nvmeTemperatureSensors = append(c.nvmeTemperatureSensors, prometheus.NewDesc(
+			metricName(fmt.Sprintf("temperature_sensor%d", i)),
+			smartLogHelp(fmt.Sprintf("Temperature reported by sensor %d in %s", i, temperatureUnit(config.temperatureScale))),
+			labels,
+			nil,
+		))
+	}
+	// sensor 0 repeats the composite temperature for dashboards iterating
+	// over all sensors
+	if config.compositeAsSensor0 {
+		c.nvmeTemperatureSensor0 = prometheus.NewDesc(
+			metricName("temperature_sensor0"),
+			smartLogHelp("Composite temperature in "+temperatureUnit(config.temperatureScale)+", same as "+metricName("temperature")),
+			labels,
+			nil,
+		)
+	}
+	if config.collectOCP {
+		c.ocp = newOcpCollector(c.runner)
+	}
+	if config.collectErrorLog {
+		c.errorLog = newErrorLogCollector(c.runner, config.maxErrorLogEntries)
+	}
+	if config.collectFirmwareLog {
+		c.firmwareLog = newFirmwareLogCollector(c.runner)
+	}
+	if config.collectEndurance {
+		c.endurance = newEnduranceCollector(c.runner)
+	}
+	if config.collectPersistentEventLog {
+		c.persistentEventLog = newPersistentEventLogCollector(c.runner)
+	}
+	if config.collectNamespace {
+		c.namespace = newNamespaceCollector(c.runner)
+	}
+	if config.collectNamespaceControllers {
+		c.namespaceControllers = newNamespaceControllersCollector(c.runner)
+	}
+	if config.collectReservations {
+		c.reservations = newReservationCollector(c.runner)
+	}
+	if config.collectPowerStates {
+		c.nvmePowerStateMaxPower = prometheus.NewDesc(
+			metricName("power_state_max_power_watts"),
+			"Maximum power drawn in each power state of the controller (psd mp) in watts",
+			[]string{"controller", "state"},
+			nil,
+		)
+	}
+	if config.healthScoreWeights != nil {
+		c.healthScoreWeights = config.healthScoreWeights
+		c.mediaErrors = newMediaErrorTracker()
+		c.nvmeDriveHealthScore = prometheus.NewDesc(
+			metricName("drive_health_score"),
+			"Drive health score from 0 to 100 derived from spare, wear, temperature and media errors",
+			labels,
+			nil,
+		)
+	}
+	if config.cacheTTL > 0 {
+		c.cache = newCollectCache(config.cacheTTL)
+	}
+	if config.adaptiveMaxInterval > 0 {
+		c.adaptive = newAdaptiveSampler(config.adaptiveMaxInterval)
+	}
+	if config.trackCounterResets {
+		c.counterResets = newCounterResetTracker()
+	}
+	if config.alwaysEmit {
+		c.availability = newAvailabilityMarkers(c.smartLogDescs()...)
+	}
+	if config.smartLogNsid != "auto" {
+		c.smartLogNsid = config.smartLogNsid
+	}
+	return c
+}
+
+// criticalWarningBitDescs returns the metrics decoded from critical_warning,
+// indexed by bit
+func (c *nvmeCollector) criticalWarningBitDescs() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		c.nvmeAvailSpareBelowThreshold,
+		c.nvmeTempThresholdExceeded,
+		c.nvmeReliabilityDegraded,
+		c.nvmeReadonly,
+		c.nvmeVmbuFailed,
+		c.nvmePmrReadonly,
+	}
+}
+
+// smartLogDescs returns the metrics read from the smart-log fields, which
+// get availability markers with --always-emit
+func (c *nvmeCollector) smartLogDescs() []*prometheus.Desc {
+	descs := append([]*prometheus.Desc{c.nvmeCriticalWarning}, c.criticalWarningBitDescs()...)
+	if c.nvmeTemperatureSensor0 != nil {
+		descs = append(descs, c.nvmeTemperatureSensor0)
 	}
+	return append(descs,
+		c.nvmeTemperature,
+		c.nvmeAvailSpare,
+		c.nvmeSpareThresh,
+		c.nvmePercentUsed,
+		c.nvmeEnduranceGrpCriticalWarningSummary,
+		c.nvmeDataUnitsRead,
+		c.nvmeDataUnitsWritten,
+		c.nvmeDataReadBytes,
+		c.nvmeDataWrittenBytes,
+		c.nvmeHostReadCommands,
+		c.nvmeHostWriteCommands,
+		c.nvmeControllerBusyTime,
+		c.nvmePowerCycles,
+		c.nvmePowerOnHours,
+		c.nvmeUnsafeShutdowns,
+		c.nvmeMediaErrors,
+		c.nvmeNumErrLogEntries,
+		c.nvmeWarningTempTime,
+		c.nvmeCriticalCompTime,
+		c.nvmeThmTemp1TransCount,
+		c.nvmeThmTemp2TransCount,
+		c.nvmeThmTemp1TotalTime,
+		c.nvmeThmTemp2TotalTime,
+	)
 }
 
 func (c *nvmeCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -204,92 +816,820 @@ func (c *nvmeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.nvmeThmTemp2TransCount
 	ch <- c.nvmeThmTemp1TotalTime
 	ch <- c.nvmeThmTemp2TotalTime
+	ch <- c.nvmeDiscoveryControllerUp
+	ch <- c.nvmeDataReadBytes
+	ch <- c.nvmeDataWrittenBytes
+	ch <- c.nvmeHostDataReadBytes
+	ch <- c.nvmeHostDataWrittenBytes
+	ch <- c.nvmeHostAnyCriticalWarning
+	ch <- c.nvmeCliBannerDetected
+	ch <- c.nvmeCollectWorkers
+	ch <- c.nvmeCollectQueueDepth
+	ch <- c.nvmeErrorLogCapacity
+	ch <- c.nvmeInflightCommands
+	ch <- c.nvmeDevicesSkipped
+	ch <- c.nvmeNamespaceCount
+	ch <- c.nvmeUp
+	ch <- c.nvmeScrapeDuration
+	ch <- c.nvmeCollectorErrors
+	ch <- c.nvmeOverCriticalTemp
+	ch <- c.nvmeCollectorEnabled
+	ch <- c.nvmeWarningTempThreshold
+	ch <- c.nvmeCriticalTempThreshold
+	ch <- c.nvmeTotalCapacity
+	ch <- c.nvmeFirmwareActivateNoReset
+	ch <- c.nvmeFirmwareSlots
+	ch <- c.nvmeRtd3EntryLatency
+	ch <- c.nvmeRtd3ExitLatency
+	ch <- c.nvmeMaxIOQueues
+	ch <- c.nvmeCurrentIOQueues
+	ch <- c.nvmeVolatileWriteCacheEnabled
+	ch <- c.nvmeHmbEnabled
+	ch <- c.nvmeHmbSize
+	ch <- c.nvmeReadonly
+	ch <- c.nvmeReliabilityDegraded
+	ch <- c.nvmeAvailSpareBelowThreshold
+	ch <- c.nvmeTempThresholdExceeded
+	ch <- c.nvmeVmbuFailed
+	ch <- c.nvmePmrReadonly
+	ch <- c.nvmeDeviceInfo
+	ch <- c.nvmeDriveLocked
+	ch <- c.nvmeDeviceFormatBranch
+	ch <- c.nvmeFabricConnectionInfo
+	ch <- c.nvmeAnaState
+	for _, desc := range c.nvmeTemperatureSensors {
+		ch <- desc
+	}
+	if c.nvmeTemperatureSensor0 != nil {
+		ch <- c.nvmeTemperatureSensor0
+	}
+	if c.counterResets != nil {
+		ch <- c.nvmeCounterResets
+	}
+	if c.ocp != nil {
+		c.ocp.Describe(ch)
+	}
+	if c.errorLog != nil {
+		c.errorLog.Describe(ch)
+	}
+	if c.firmwareLog != nil {
+		c.firmwareLog.Describe(ch)
+	}
+	if c.endurance != nil {
+		c.endurance.Describe(ch)
+	}
+	if c.persistentEventLog != nil {
+		c.persistentEventLog.Describe(ch)
+	}
+	if c.adaptive != nil {
+		c.adaptive.Describe(ch)
+	}
+	if c.availability != nil {
+		c.availability.Describe(ch)
+	}
+	if c.nvmeDriveHealthScore != nil {
+		ch <- c.nvmeDriveHealthScore
+	}
+	if c.nvmePowerStateMaxPower != nil {
+		ch <- c.nvmePowerStateMaxPower
+	}
+	if c.namespace != nil {
+		c.namespace.Describe(ch)
+	}
+	if c.namespaceControllers != nil {
+		c.namespaceControllers.Describe(ch)
+	}
+	if c.reservations != nil {
+		c.reservations.Describe(ch)
+	}
+	for _, extra := range c.extraCollectors {
+		extra.Describe(ch)
+	}
 }
 
 func (c *nvmeCollector) Collect(ch chan<- prometheus.Metric) {
-	nvmeDeviceCmd, err := exec.Command("nvme", "list", "-o", "json").Output()
+	if c.cache != nil {
+		c.cache.collect(ch, c.collect)
+		return
+	}
+	c.collect(ch)
+}
+
+func (c *nvmeCollector) collect(ch chan<- prometheus.Metric) {
+	for name, enabled := range c.collectors {
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.nvmeCollectorEnabled, prometheus.GaugeValue, value, name)
+	}
+	c.banners.reset()
+	start := time.Now()
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(c.nvmeScrapeDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+	}()
+	nvmeDeviceCmd, err := runNvmeJSON(c.runner, "list", "-v", "-o", "json")
+	if err != nil {
+		warnf("Error running nvme list command: %s\n", err)
+		ch <- prometheus.MustNewConstMetric(c.nvmeUp, prometheus.GaugeValue, 0)
+		return
+	}
+	nvmeNamespaces, nvmeControllers, err := getDeviceList(nvmeDeviceCmd, c.listLayout)
+	if err != nil {
+		warnf("Error parsing nvme list output: %s\n", err)
+		ch <- prometheus.MustNewConstMetric(c.nvmeUp, prometheus.GaugeValue, 0)
+		return
+	}
+	if c.listNsFallback {
+		nvmeNamespaces = appendListedNamespaces(c.runner, nvmeNamespaces, nvmeControllers)
+	}
+	up := 0.0
+	if len(nvmeNamespaces) > 0 {
+		up = 1
+		markDevicesDiscovered()
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeUp, prometheus.GaugeValue, up)
+	if c.deviceFilter != nil {
+		nvmeNamespaces, nvmeControllers = c.deviceFilter.filter(nvmeNamespaces, nvmeControllers)
+	}
+	// counted before max-devices so the limit doesn't look like lost namespaces
+	namespaceCounts := make(map[string]float64)
+	for _, namespace := range nvmeNamespaces {
+		namespaceCounts[namespace.Controller]++
+	}
+	for _, controller := range nvmeControllers {
+		if !controller.Discovery {
+			ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceCount, prometheus.GaugeValue, namespaceCounts[controller.Name], controller.Name)
+		}
+	}
+	// bound the work when a rescan enumerates a large number of devices
+	if c.maxDevices > 0 && len(nvmeNamespaces) > c.maxDevices {
+		sort.SliceStable(nvmeNamespaces, func(i, j int) bool {
+			return nvmeNamespaces[i].DevicePath < nvmeNamespaces[j].DevicePath
+		})
+		warnf("Collecting %d of %d devices, limited by max-devices\n", c.maxDevices, len(nvmeNamespaces))
+		c.mu.Lock()
+		c.devicesSkipped += float64(len(nvmeNamespaces) - c.maxDevices)
+		c.mu.Unlock()
+		nvmeNamespaces = nvmeNamespaces[:c.maxDevices]
+	}
+	c.mu.Lock()
+	devicesSkipped := c.devicesSkipped
+	c.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.nvmeDevicesSkipped, prometheus.CounterValue, devicesSkipped)
+	// id-ctrl is run once per controller, its namespaces share the result
+	idCtrls := make(map[string]gjson.Result)
+	// controllers whose devices are skipped by the command policy of a
+	// failed id-ctrl or smart-log
+	skippedControllers := make(map[string]bool)
+	controllersByName := make(map[string]nvmeController)
+	devicesByController := make(map[string][]string)
+	for _, namespace := range nvmeNamespaces {
+		devicesByController[namespace.Controller] = append(devicesByController[namespace.Controller], namespace.DevicePath)
+	}
+	for _, controller := range nvmeControllers {
+		controllersByName[controller.Name] = controller
+		if c.smartOnly {
+			continue
+		}
+		// tcp, rdma and fc controllers report the fabrics address they are connected to
+		if controller.Transport != "" && controller.Transport != "pcie" {
+			ch <- prometheus.MustNewConstMetric(c.nvmeFabricConnectionInfo, prometheus.GaugeValue, 1, controller.Name, controller.Transport, fabricAddress(controller.Address))
+		}
+		for _, path := range controller.Paths {
+			if path.ANAState != "" {
+				ch <- prometheus.MustNewConstMetric(c.nvmeAnaState, prometheus.GaugeValue, 1, pathNamespace(path.Name), controller.Name, path.Name, path.ANAState)
+			}
+		}
+		if !controller.Discovery {
+			if idCtrl, ok := c.collectController(ch, controller, devicesByController[controller.Name]); ok {
+				idCtrls[controller.Name] = idCtrl
+			} else if policyFor("id-ctrl").SkipDevice {
+				skippedControllers[controller.Name] = true
+				continue
+			}
+			for _, extra := range c.extraCollectors {
+				if extra.scope == "controller" {
+					extra.collect(ch, c.runner, "", controller.Name, controller.Name)
+				}
+			}
+			continue
+		}
+		// discovery controllers have no smart-log, only report whether they are reachable
+		state, err := readSysfsAttr(controller.Name, "state")
+		if err != nil {
+			warnf("Error reading state of discovery controller %s: %s\n", controller.Name, err)
+		}
+		up := 0.0
+		if state == "live" {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.nvmeDiscoveryControllerUp, prometheus.GaugeValue, up, controller.Name, fabricAddress(controller.Address))
+	}
+	// smart-log counters are controller wide, collect them once per
+	// controller from its first namespace so they aren't double counted
+	var smartLogNamespaces []nvmeNamespace
+	smartLogControllers := make(map[string]bool)
+	for _, namespace := range nvmeNamespaces {
+		if skippedControllers[namespace.Controller] || smartLogControllers[namespace.Controller] {
+			continue
+		}
+		smartLogControllers[namespace.Controller] = true
+		// smart-log fails through controllers whose paths are all
+		// inaccessible, their identity and ANA state are still exported
+		if controllersByName[namespace.Controller].inaccessible() {
+			debugf("Skipping smart-log for device %s: controller %s is inaccessible\n", namespace.DevicePath, namespace.Controller)
+			continue
+		}
+		smartLogNamespaces = append(smartLogNamespaces, namespace)
+	}
+	workers := c.concurrency
+	if workers > len(smartLogNamespaces) {
+		workers = len(smartLogNamespaces)
+	}
+	results, queueDepth := c.collectSmartLogs(ch, smartLogNamespaces, idCtrls, workers)
+	ch <- prometheus.MustNewConstMetric(c.nvmeCollectWorkers, prometheus.GaugeValue, float64(c.concurrency))
+	ch <- prometheus.MustNewConstMetric(c.nvmeCollectQueueDepth, prometheus.GaugeValue, float64(queueDepth))
+	// totals and skipped controllers are computed once all workers are done
+	var hostDataReadBytes, hostDataWrittenBytes, hostAnyCriticalWarning float64
+	for i, namespace := range smartLogNamespaces {
+		summary, err := results[i].summary, results[i].err
+		if err != nil {
+			c.mu.Lock()
+			c.collectorErrors[namespace.DevicePath]++
+			c.mu.Unlock()
+		}
+		if err != nil && policyFor("smart-log").SkipDevice {
+			warnf("Skipping device %s: %s\n", namespace.DevicePath, err)
+			skippedControllers[namespace.Controller] = true
+			continue
+		}
+		if err != nil {
+			warnf("Skipping smart-log metrics for device %s: %s\n", namespace.DevicePath, err)
+		}
+		hostDataReadBytes += summary.dataUnitsRead * dataUnitBytes
+		hostDataWrittenBytes += summary.dataUnitsWritten * dataUnitBytes
+		if summary.criticalWarning != 0 {
+			hostAnyCriticalWarning = 1
+		}
+	}
+	for _, namespace := range nvmeNamespaces {
+		nvmeDevice := namespace.DevicePath
+		if skippedControllers[namespace.Controller] {
+			continue
+		}
+		if c.smartOnly {
+			continue
+		}
+		// devices without an alias get an empty alias
+		idCtrl := idCtrls[namespace.Controller]
+		model, serial, firmware := controllerIdentity(controllersByName[namespace.Controller], idCtrl)
+		ch <- prometheus.MustNewConstMetric(c.nvmeDeviceInfo, prometheus.GaugeValue, 1, nvmeDevice, c.deviceAliases[nvmeDevice], stableID(namespace, idCtrl),
+			namespace.Controller, model, serial, firmware)
+		if namespace.Layout != "" {
+			ch <- prometheus.MustNewConstMetric(c.nvmeDeviceFormatBranch, prometheus.GaugeValue, 1, nvmeDevice, namespace.Layout)
+		}
+		if c.namespace != nil {
+			c.namespace.collect(ch, nvmeDevice)
+		}
+		if c.namespaceControllers != nil {
+			c.namespaceControllers.collect(ch, namespace)
+		}
+		if c.reservations != nil {
+			c.reservations.collect(ch, nvmeDevice)
+		}
+		for _, extra := range c.extraCollectors {
+			if extra.scope == "device" {
+				extra.collect(ch, c.runner, nvmeDevice, namespace.Controller, nvmeDevice)
+			}
+		}
+		// inflight counts are only meaningful for local PCIe block devices
+		if isGenericDevice(nvmeDevice) {
+			continue
+		}
+		if transport, err := readSysfsAttr(namespace.Controller, "transport"); err == nil && transport == "pcie" {
+			inflight, err := readInflight(nvmeDevice)
+			if err != nil {
+				warnf("Error reading inflight commands for device %s: %s\n", nvmeDevice, err)
+			} else {
+				ch <- prometheus.MustNewConstMetric(c.nvmeInflightCommands, prometheus.GaugeValue, inflight, nvmeDevice)
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeHostDataReadBytes, prometheus.CounterValue, hostDataReadBytes)
+	ch <- prometheus.MustNewConstMetric(c.nvmeHostDataWrittenBytes, prometheus.CounterValue, hostDataWrittenBytes)
+	ch <- prometheus.MustNewConstMetric(c.nvmeHostAnyCriticalWarning, prometheus.GaugeValue, hostAnyCriticalWarning)
+	bannerDetected := 0.0
+	if c.banners.reset() {
+		bannerDetected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeCliBannerDetected, prometheus.GaugeValue, bannerDetected)
+	c.mu.Lock()
+	for device, count := range c.collectorErrors {
+		ch <- prometheus.MustNewConstMetric(c.nvmeCollectorErrors, prometheus.CounterValue, count, device)
+	}
+	c.mu.Unlock()
+}
+
+// smartLogSummary holds the smart-log values rolled up across devices
+type smartLogSummary struct {
+	dataUnitsRead    float64
+	dataUnitsWritten float64
+	criticalWarning  float64
+}
+
+// collectSmartLog exports the smart-log of a device and returns the values
+// rolled up across devices. idCtrl is the id-ctrl output of its controller.
+func (c *nvmeCollector) collectSmartLog(ch chan<- prometheus.Metric, namespace nvmeNamespace, idCtrl gjson.Result) (smartLogSummary, error) {
+	nvmeDevice := namespace.DevicePath
+	label := c.smartLogLabel(namespace)
+	smartLogArgs := []string{"smart-log", nvmeDevice, "-o", "json"}
+	if c.smartLogNsid != "" {
+		smartLogArgs = append(smartLogArgs, "-n", c.smartLogNsid)
+	}
+	nvmeSmartLog, err := runNvmeJSON(c.runner, smartLogArgs...)
+	if isLockedError(err) {
+		warnf("Skipping smart-log for device %s: drive is locked\n", nvmeDevice)
+		ch <- prometheus.MustNewConstMetric(c.nvmeDriveLocked, prometheus.GaugeValue, 1, label)
+		return smartLogSummary{}, nil
+	}
 	if err != nil {
-		log.Fatalf("Error running nvme command: %s\n", err)
+		return smartLogSummary{}, fmt.Errorf("error running nvme smart-log command: %s", err)
+	}
+	if !gjson.Valid(string(nvmeSmartLog)) {
+		return smartLogSummary{}, errors.New("smart-log json is not valid")
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeDriveLocked, prometheus.GaugeValue, 0, label)
+	nvmeSmartLogMetrics := gjson.GetMany(string(nvmeSmartLog),
+		"critical_warning",
+		"temperature",
+		"avail_spare",
+		"spare_thresh",
+		"percent_used",
+		"endurance_grp_critical_warning_summary",
+		"data_units_read",
+		"data_units_written",
+		"host_read_commands",
+		"host_write_commands",
+		"controller_busy_time",
+		"power_cycles",
+		"power_on_hours",
+		"unsafe_shutdowns",
+		"media_errors",
+		"num_err_log_entries",
+		"warning_temp_time",
+		"critical_comp_time",
+		"thm_temp1_trans_count",
+		"thm_temp2_trans_count",
+		"thm_temp1_total_time",
+		"thm_temp2_total_time")
+
+	criticalWarning := parseCriticalWarning(nvmeSmartLogMetrics[0])
+	criticalWarningAvailable := nvmeSmartLogMetrics[0].Exists()
+	c.smartLogFloat(ch, c.nvmeCriticalWarning, prometheus.GaugeValue, criticalWarning, criticalWarningAvailable, label)
+	// decode the bitfield so old-format drives, which only report the
+	// raw value, get the same metrics as newer nvme-cli output
+	for bit, desc := range c.criticalWarningBitDescs() {
+		c.smartLogFloat(ch, desc, prometheus.GaugeValue, criticalWarningBit(criticalWarning, uint(bit)), criticalWarningAvailable, label)
+	}
+	// convert kelvin to the configured scale, 0 kelvin means the drive has
+	// no reading and is skipped rather than reported as absolute zero, or
+	// marked unavailable with --always-emit
+	temperature := nvmeSmartLogMetrics[1].Float()
+	if temperature > 0 || c.availability != nil {
+		c.smartLogFloat(ch, c.nvmeTemperature, prometheus.GaugeValue, convertTemperature(temperature, c.temperatureScale), temperature > 0, label)
+		if c.nvmeTemperatureSensor0 != nil {
+			c.smartLogFloat(ch, c.nvmeTemperatureSensor0, prometheus.GaugeValue, convertTemperature(temperature, c.temperatureScale), temperature > 0, label)
+		}
+	}
+	c.smartLogValue(ch, c.nvmeAvailSpare, prometheus.GaugeValue, nvmeSmartLogMetrics[2], label)
+	c.smartLogValue(ch, c.nvmeSpareThresh, prometheus.GaugeValue, nvmeSmartLogMetrics[3], label)
+	c.smartLogValue(ch, c.nvmePercentUsed, prometheus.GaugeValue, nvmeSmartLogMetrics[4], label)
+	c.smartLogValue(ch, c.nvmeEnduranceGrpCriticalWarningSummary, prometheus.GaugeValue, nvmeSmartLogMetrics[5], label)
+	c.smartLogValue(ch, c.nvmeDataUnitsRead, prometheus.CounterValue, nvmeSmartLogMetrics[6], label)
+	c.smartLogValue(ch, c.nvmeDataUnitsWritten, prometheus.CounterValue, nvmeSmartLogMetrics[7], label)
+	// data units are thousands of 512 byte blocks
+	c.smartLogFloat(ch, c.nvmeDataReadBytes, prometheus.CounterValue, nvmeSmartLogMetrics[6].Float()*dataUnitBytes, nvmeSmartLogMetrics[6].Exists(), label)
+	c.smartLogFloat(ch, c.nvmeDataWrittenBytes, prometheus.CounterValue, nvmeSmartLogMetrics[7].Float()*dataUnitBytes, nvmeSmartLogMetrics[7].Exists(), label)
+	c.smartLogValue(ch, c.nvmeHostReadCommands, prometheus.CounterValue, nvmeSmartLogMetrics[8], label)
+	c.smartLogValue(ch, c.nvmeHostWriteCommands, prometheus.CounterValue, nvmeSmartLogMetrics[9], label)
+	c.smartLogValue(ch, c.nvmeControllerBusyTime, prometheus.CounterValue, nvmeSmartLogMetrics[10], label)
+	c.smartLogValue(ch, c.nvmePowerCycles, prometheus.CounterValue, nvmeSmartLogMetrics[11], label)
+	c.smartLogValue(ch, c.nvmePowerOnHours, prometheus.CounterValue, nvmeSmartLogMetrics[12], label)
+	c.smartLogValue(ch, c.nvmeUnsafeShutdowns, prometheus.CounterValue, nvmeSmartLogMetrics[13], label)
+	c.smartLogValue(ch, c.nvmeMediaErrors, prometheus.CounterValue, nvmeSmartLogMetrics[14], label)
+	c.smartLogValue(ch, c.nvmeNumErrLogEntries, prometheus.CounterValue, nvmeSmartLogMetrics[15], label)
+	c.smartLogValue(ch, c.nvmeWarningTempTime, prometheus.CounterValue, nvmeSmartLogMetrics[16], label)
+	c.smartLogValue(ch, c.nvmeCriticalCompTime, prometheus.CounterValue, nvmeSmartLogMetrics[17], label)
+	c.smartLogValue(ch, c.nvmeThmTemp1TransCount, prometheus.CounterValue, nvmeSmartLogMetrics[18], label)
+	c.smartLogValue(ch, c.nvmeThmTemp2TransCount, prometheus.CounterValue, nvmeSmartLogMetrics[19], label)
+	c.smartLogValue(ch, c.nvmeThmTemp1TotalTime, prometheus.CounterValue, nvmeSmartLogMetrics[20], label)
+	c.smartLogValue(ch, c.nvmeThmTemp2TotalTime, prometheus.CounterValue, nvmeSmartLogMetrics[21], label)
+	if c.healthScoreWeights != nil {
+		mediaErrorGrowth := c.mediaErrors.growth(nvmeDevice, nvmeSmartLogMetrics[14].Float())
+		score := c.healthScoreWeights.score(nvmeSmartLogMetrics[2].Float(), nvmeSmartLogMetrics[3].Float(), nvmeSmartLogMetrics[4].Float(),
+			nvmeSmartLogMetrics[16].Float(), nvmeSmartLogMetrics[17].Float(), mediaErrorGrowth)
+		ch <- prometheus.MustNewConstMetric(c.nvmeDriveHealthScore, prometheus.GaugeValue, score, label)
+	}
+	for i, desc := range c.nvmeTemperatureSensors {
+		// unimplemented sensors report 0
+		if sensor := gjson.GetBytes(nvmeSmartLog, fmt.Sprintf("temperature_sensor_%d", i+1)); sensor.Float() > 0 {
+			ch <- c.temperatureMetric(desc, sensor.Float(), label)
+		}
+	}
+	// wctemp and cctemp are reported in kelvin like the smart-log temperature, 0 if not reported
+	if wctemp := idCtrl.Get("wctemp").Float(); wctemp > 0 {
+		ch <- c.temperatureMetric(c.nvmeWarningTempThreshold, wctemp, label)
+	}
+	if cctemp := idCtrl.Get("cctemp").Float(); cctemp > 0 {
+		ch <- c.temperatureMetric(c.nvmeCriticalTempThreshold, cctemp, label)
+		overCriticalTemp := 0.0
+		if nvmeSmartLogMetrics[1].Float() >= cctemp {
+			overCriticalTemp = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.nvmeOverCriticalTemp, prometheus.GaugeValue, overCriticalTemp, label)
+	}
+	if c.counterResets != nil {
+		var counters []float64
+		for _, metric := range nvmeSmartLogMetrics[6:] {
+			counters = append(counters, metric.Float())
+		}
+		ch <- prometheus.MustNewConstMetric(c.nvmeCounterResets, prometheus.CounterValue, c.counterResets.observe(nvmeDevice, counters), label)
 	}
-	if !gjson.Valid(string(nvmeDeviceCmd)) {
-		log.Fatal("nvmeDeviceCmd json is not valid")
+	return smartLogSummary{
+		dataUnitsRead:    nvmeSmartLogMetrics[6].Float(),
+		dataUnitsWritten: nvmeSmartLogMetrics[7].Float(),
+		criticalWarning:  criticalWarning,
+	}, nil
+}
+
+// smartLogLabel returns the device label of the smart-log metrics of a
+// namespace. smart-log counters are controller wide and can be labeled with
+// the controller instead of the namespace they were read through.
+func (c *nvmeCollector) smartLogLabel(namespace nvmeNamespace) string {
+	if c.deviceLabel == deviceLabelController {
+		return namespace.Controller
 	}
-	nvmeDeviceList := gjson.Get(string(nvmeDeviceCmd), "Devices.#.DevicePath")
-	for _, nvmeDevice := range nvmeDeviceList.Array() {
-		nvmeSmartLog, err := exec.Command("nvme", "smart-log", nvmeDevice.String(), "-o", "json").Output()
+	return namespace.DevicePath
+}
+
+// parseCriticalWarning returns the critical_warning bitfield. Newer nvme-cli
+// releases report an object with the raw value under "value", older ones
+// a number, and some builds a hex or decimal string such as "0x05".
+func parseCriticalWarning(criticalWarning gjson.Result) float64 {
+	switch {
+	case criticalWarning.IsObject():
+		return parseCriticalWarning(criticalWarning.Get("value"))
+	case criticalWarning.Type == gjson.String:
+		value, err := strconv.ParseUint(strings.TrimSpace(criticalWarning.String()), 0, 8)
 		if err != nil {
-			log.Fatalf("Error running nvme smart-log command for device %s: %s\n", nvmeDevice.String(), err)
-		}
-		if !gjson.Valid(string(nvmeSmartLog)) {
-			log.Fatalf("nvmeSmartLog json is not valid for device: %s: %s\n", nvmeDevice.String(), err)
-		}
-		nvmeSmartLogMetrics := gjson.GetMany(string(nvmeSmartLog),
-                                                     "critical_warning",
-                                                     "temperature",
-                                                     "avail_spare",
-                                                     "spare_thresh",
-                                                     "percent_used",
-                                                     "endurance_grp_critical_warning_summary",
-                                                     "data_units_read",
-                                                     "data_units_written",
-                                                     "host_read_commands",
-                                                     "host_write_commands",
-                                                     "controller_busy_time",
-                                                     "power_cycles",
-                                                     "power_on_hours",
-                                                     "unsafe_shutdowns",
-                                                     "media_errors",
-                                                     "num_err_log_entries",
-                                                     "warning_temp_time",
-                                                     "critical_comp_time",
-                                                     "thm_temp1_trans_count",
-                                                     "thm_temp2_trans_count",
-                                                     "thm_temp1_total_time",
-                                                     "thm_temp2_total_time",)
-
-		ch <- prometheus.MustNewConstMetric(c.nvmeCriticalWarning, prometheus.GaugeValue, nvmeSmartLogMetrics[0].Float(), nvmeDevice.String())
-		// convert kelvin to fahrenheit
-		ch <- prometheus.MustNewConstMetric(c.nvmeTemperature, prometheus.GaugeValue, (nvmeSmartLogMetrics[1].Float() - 273.15) * 9/5 + 32, nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeAvailSpare, prometheus.GaugeValue, nvmeSmartLogMetrics[2].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeSpareThresh, prometheus.GaugeValue, nvmeSmartLogMetrics[3].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmePercentUsed, prometheus.GaugeValue, nvmeSmartLogMetrics[4].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeEnduranceGrpCriticalWarningSummary, prometheus.GaugeValue, nvmeSmartLogMetrics[5].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeDataUnitsRead, prometheus.CounterValue, nvmeSmartLogMetrics[6].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeDataUnitsWritten, prometheus.CounterValue, nvmeSmartLogMetrics[7].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeHostReadCommands, prometheus.CounterValue, nvmeSmartLogMetrics[8].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeHostWriteCommands, prometheus.CounterValue, nvmeSmartLogMetrics[9].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeControllerBusyTime, prometheus.CounterValue, nvmeSmartLogMetrics[10].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmePowerCycles, prometheus.CounterValue, nvmeSmartLogMetrics[11].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmePowerOnHours, prometheus.CounterValue, nvmeSmartLogMetrics[12].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeUnsafeShutdowns, prometheus.CounterValue, nvmeSmartLogMetrics[13].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeMediaErrors, prometheus.CounterValue, nvmeSmartLogMetrics[14].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeNumErrLogEntries, prometheus.CounterValue, nvmeSmartLogMetrics[15].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeWarningTempTime, prometheus.CounterValue, nvmeSmartLogMetrics[16].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeCriticalCompTime, prometheus.CounterValue, nvmeSmartLogMetrics[17].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeThmTemp1TransCount, prometheus.CounterValue, nvmeSmartLogMetrics[18].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeThmTemp2TransCount, prometheus.CounterValue, nvmeSmartLogMetrics[19].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeThmTemp1TotalTime, prometheus.CounterValue, nvmeSmartLogMetrics[20].Float(), nvmeDevice.String())
-		ch <- prometheus.MustNewConstMetric(c.nvmeThmTemp2TotalTime, prometheus.CounterValue, nvmeSmartLogMetrics[21].Float(), nvmeDevice.String())
+			warnf("Error parsing critical_warning %q: %s\n", criticalWarning.String(), err)
+			return 0
+		}
+		return float64(value)
+	}
+	return criticalWarning.Float()
+}
+
+// criticalWarningBit returns 1 if the given bit of critical_warning is set
+func criticalWarningBit(criticalWarning float64, bit uint) float64 {
+	return float64(uint64(criticalWarning) >> bit & 1)
+}
+
+// lockedStatuses are the NVMe statuses, status code type and status code
+// without the retry and DNR bits, returned by locked self-encrypting drives:
+// Access Denied, and Operation Denied from security protocol commands
+var lockedStatuses = map[uint64]bool{
+	0x286: true,
+	0x015: true,
+}
+
+// nvmeStatusRegexp matches the status nvme-cli prints at the end of a
+// failed command, e.g. "NVMe status: Access Denied: Access to the namespace
+// and/or LBA range is denied due to lack of access rights(0x4286)"
+var nvmeStatusRegexp = regexp.MustCompile(`NVMe status: .*\(0x([0-9a-fA-F]+)\)`)
+
+// isLockedError reports whether an nvme command failed with a status
+// returned by locked self-encrypting drives
+func isLockedError(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	m := nvmeStatusRegexp.FindSubmatch(exitErr.Stderr)
+	if m == nil {
+		return false
+	}
+	status, err := strconv.ParseUint(string(m[1]), 16, 16)
+	if err != nil {
+		return false
+	}
+	return lockedStatuses[status&0x7ff]
+}
+
+// printEffectiveConfig prints the configuration --validate-config resolved
+// from the flags, with collect-smart-only and the files applied
+func printEffectiveConfig(w io.Writer, config collectorConfig, listenAddress string, metricExclude string, includeDevices string, excludeDevices string) {
+	orNone := func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	}
+	fmt.Fprintln(w, "Configuration is valid")
+	fmt.Fprintf(w, "listen address: %s\n", listenAddress)
+	fmt.Fprintf(w, "collectors: %s\n", strings.Join(config.enabledCollectors(), ", "))
+	var extra []string
+	for _, e := range config.extraCollectors {
+		extra = append(extra, e.name)
+	}
+	fmt.Fprintf(w, "extra collectors: %s\n", orNone(strings.Join(extra, ", ")))
+	fmt.Fprintf(w, "excluded metrics: %s\n", orNone(metricExclude))
+	fmt.Fprintf(w, "include devices: %s\n", orNone(includeDevices))
+	fmt.Fprintf(w, "exclude devices: %s\n", orNone(excludeDevices))
+}
+
+// runtimeCollectors export the exporter's own go_* and process_* metrics
+func runtimeCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	}
 }
 
+// newRegistry registers the runtime collectors explicitly rather than
+// relying on the default registry
+func newRegistry(exporter prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(append(runtimeCollectors(), exporter)...)
+	return registry
+}
+
 func main() {
-	port := flag.String("port", "9998", "port to listen on")
+	listenAddress := flag.String("listen-address", "", "address to listen on, e.g. 127.0.0.1:9998, defaults to all interfaces on port")
+	port := flag.String("port", "9998", "port to listen on, deprecated in favor of listen-address")
+	tlsCertFile := flag.String("tls-cert-file", "", "certificate file to serve metrics over https, requires tls-key-file")
+	tlsKeyFile := flag.String("tls-key-file", "", "private key file of tls-cert-file")
+	validateConfig := flag.Bool("validate-config", false, "check the flags and the files they reference, then exit without collecting")
+	collectOCP := flag.Bool("collect-ocp", false, "collect metrics from the OCP smart extended log")
+	collectNamespace := flag.Bool("collect-namespace", false, "collect metrics from nvme id-ns")
+	collectNamespaceControllers := flag.Bool("collect-namespace-controllers", false, "collect the number of controllers attached to each namespace with nvme list-ctrl")
+	collectReservations := flag.Bool("collect-reservations", false, "collect reservation state with nvme resv-report")
+	collectPersistentEventLog := flag.Bool("collect-persistent-event-log", false, "collect metrics from the persistent event log")
+	includeDevices := flag.String("include-devices", "", "comma separated regexes of device paths to collect, matched against the whole path, e.g. /dev/nvme[0-9]+n1")
+	excludeDevices := flag.String("exclude-devices", "", "comma separated regexes of device paths not to collect, takes precedence over include-devices")
+	prefix := flag.String("metric-prefix", metricPrefix, "prefix of metric names, replacing nvme")
+	metricExclude := flag.String("metric-exclude", "", "regex of nvme metric names to drop, matched against the whole name")
+	deviceLabel := flag.String("device-label", deviceLabelNamespace, "device label of smart-log metrics, one of namespace or controller")
+	healthScore := flag.Bool("health-score", false, "export nvme_drive_health_score derived from smart-log values")
+	healthScoreWeightsFile := flag.String("health-score-weights-file", "", "json file overriding the weights of the health score factors, implies health-score")
+	alwaysEmit := flag.Bool("always-emit", false, "emit nvme_<metric>_available for each smart-log metric and leave out values missing from the drive's output instead of reporting 0")
+	adaptiveMaxInterval := flag.Duration("adaptive-max-interval", 0, "back off collecting smart-log from drives whose values don't change, up to this interval, 0 to collect every scrape")
+	collectSmartOnly := flag.Bool("collect-smart-only", false, "only collect smart-log metrics, disabling every other collector and id-ctrl")
+	collectFirmwareLog := flag.Bool("collect-firmware-log", false, "collect the firmware revision of each slot with nvme fw-log")
+	collectEndurance := flag.Bool("collect-endurance", false, "collect wear metrics of each endurance group with nvme endurance-log")
+	collectPowerStates := flag.Bool("collect-power-states", false, "collect the maximum power of each power state from id-ctrl")
+	collectQueues := flag.Bool("collect-queues", false, "collect the maximum and current number of I/O queues with nvme get-feature")
+	collectVolatileWriteCache := flag.Bool("collect-volatile-write-cache", false, "collect whether the volatile write cache is enabled with nvme get-feature")
+	collectHostMemoryBuffer := flag.Bool("collect-host-memory-buffer", false, "collect whether the host memory buffer is enabled and its size with nvme get-feature")
+	collectErrorLog := flag.Bool("collect-error-log", false, "collect metrics from the error information log")
+	maxErrorLogEntries := flag.Int("max-error-log-entries", 16, "maximum number of error log entries exported per controller with collect-error-log")
+	verboseHelp := flag.Bool("verbose-help", false, "append NVMe specification references to metric help text")
+	pushGateway := flag.String("push-gateway", "", "Pushgateway URL to push metrics to, disabled when empty")
+	pushInterval := flag.Duration("push-interval", time.Minute, "interval between pushes to the Pushgateway")
+	pushJob := flag.String("push-job", "nvme_exporter", "job label used when pushing to the Pushgateway")
+	pushInstance := flag.String("push-instance", "", "instance label used when pushing to the Pushgateway, defaults to the hostname")
+	logLevel := flag.String("log-level", "info", "log level, one of debug, info, warn or error")
+	quiet := flag.Bool("quiet", false, "only log errors, same as --log-level=error")
+	trackCounterResets := flag.Bool("track-counter-resets", false, "count smart-log counters that decrease between scrapes")
+	concurrency := flag.Int("concurrency", 8, "maximum number of devices whose smart-log is collected concurrently")
+	maxDevices := flag.Int("max-devices", 0, "maximum number of devices collected per scrape, 0 for no limit")
+	temperatureScale := flag.String("temperature-scale", scaleFahrenheit, "scale of exported temperatures, one of celsius, fahrenheit or kelvin")
+	listLayout := flag.String("list-layout", layoutAuto, "layout of nvme list output to parse, one of auto, namespaces (also subsystems), controllers or devicepaths, auto checks every layout")
+	listNsFallback := flag.Bool("list-ns-fallback", false, "enumerate namespaces with nvme list-ns for controllers listed without namespaces")
+	cacheTTL := flag.Duration("cache-ttl", 0, "serve the nvme metrics of the previous collection to scrapes within this ttl, 0 to always collect")
+	minScrapeInterval := flag.Duration("min-scrape-interval", 0, "serve the previous result to scrapes within this interval of the last collection, 0 to always collect")
+	maxTempSensors := flag.Int("max-temp-sensors", 8, "number of temperature sensors exported per device")
+	deviceAliasFile := flag.String("device-alias-file", "", "json file mapping device paths to aliases exported on nvme_device_info")
+	compositeAsSensor0 := flag.Bool("composite-as-sensor0", false, "also export the composite temperature as nvme_temperature_sensor0")
+	extraCollectorsFile := flag.String("extra-collectors-file", "", "json file defining extra nvme commands to collect metrics from")
+	onDemand := flag.Bool("on-demand", false, "only collect when triggered with a POST to /collect, /metrics serves the result of the last trigger")
+	commandPolicyFile := flag.String("command-policy-file", "", "json file with the retry and skip policy of nvme subcommands")
+	cmdTimeout := flag.Duration("command-timeout", 10*time.Second, "timeout of each nvme command, a device whose command times out is skipped, 0 for no timeout")
+	skipPrivilegeCheck := flag.Bool("skip-privilege-check", false, "don't run nvme list at startup to check that nvme can be run with the exporter's privileges")
+	sudo := flag.Bool("use-sudo", false, "run nvme with sudo -n so the exporter can run as an unprivileged user")
+	nsenter := flag.String("nsenter-target", "", "run nvme in the mount and network namespaces of this pid with nsenter, e.g. 1 for the host's nvme-cli")
+	fixtureDir := flag.String("fixture-dir", "", "run the nvme stub in DIR/bin and read sysfs from DIR/sys instead of using real drives, for integration tests")
+	textfileOutput := flag.String("textfile-output", "", "write metrics to this file for the node_exporter textfile collector instead of serving them over http")
+	collectInterval := flag.Duration("collect-interval", time.Minute, "interval between writes to the textfile-output file")
+	smartLogNsid := flag.String("smart-log-nsid", "auto", "namespace id passed to nvme smart-log, e.g. 0xffffffff for controller-wide data, or auto to use the device's namespace")
 	flag.Parse()
-	// check user
-	currentUser, err := user.Current()
+	level, err := parseLogLevel(*logLevel)
 	if err != nil {
-		log.Fatalf("Error getting current user  %s\n", err)
+		log.Fatalf("Invalid log-level: %s\n", err)
 	}
-	if currentUser.Username != "root" {
-		log.Fatalln("Error: you must be root to use nvme-cli")
+	currentLogLevel = level
+	if *quiet {
+		currentLogLevel = logLevelError
 	}
-	// check for nvme-cli executable
-	_, err = exec.LookPath("nvme")
-	if err != nil {
+	if err := validateTemperatureScale(*temperatureScale); err != nil {
+		log.Fatalf("Invalid temperature-scale: %s\n", err)
+	}
+	if *deviceLabel != deviceLabelNamespace && *deviceLabel != deviceLabelController {
+		log.Fatalf("Invalid device-label %q, must be one of namespace or controller\n", *deviceLabel)
+	}
+	if *listLayout, err = parseListLayout(*listLayout); err != nil {
+		log.Fatalf("Invalid list-layout: %s\n", err)
+	}
+	if !metricPrefixRegexp.MatchString(*prefix) {
+		log.Fatalf("Invalid metric-prefix %q, must match %s\n", *prefix, metricPrefixRegexp)
+	}
+	metricPrefix = *prefix
+	if *concurrency < 1 {
+		log.Fatalf("Invalid concurrency %d, must be at least 1\n", *concurrency)
+	}
+	if *maxErrorLogEntries < 0 {
+		log.Fatalf("Invalid max-error-log-entries %d, must not be negative\n", *maxErrorLogEntries)
+	}
+	if *cmdTimeout < 0 {
+		log.Fatalf("Invalid command-timeout %s, must not be negative\n", *cmdTimeout)
+	}
+	commandTimeout = *cmdTimeout
+	if *nsenter != "" {
+		if _, err := strconv.ParseUint(*nsenter, 10, 32); err != nil {
+			log.Fatalf("Invalid nsenter-target %q: %s\n", *nsenter, err)
+		}
+	}
+	if *smartLogNsid != "auto" {
+		if _, err := strconv.ParseUint(*smartLogNsid, 0, 32); err != nil {
+			log.Fatalf("Invalid smart-log-nsid %q: %s\n", *smartLogNsid, err)
+		}
+	}
+	if *listenAddress == "" {
+		if _, err := net.LookupPort("tcp", *port); err != nil {
+			log.Fatalf("Invalid port: %s\n", err)
+		}
+		*listenAddress = ":" + *port
+	}
+	if _, listenPort, err := net.SplitHostPort(*listenAddress); err != nil {
+		log.Fatalf("Invalid listen-address: %s\n", err)
+	} else if _, err := net.LookupPort("tcp", listenPort); err != nil {
+		log.Fatalf("Invalid listen-address: %s\n", err)
+	}
+	if *pushGateway != "" {
+		if _, err := url.ParseRequestURI(*pushGateway); err != nil {
+			log.Fatalf("Invalid push-gateway: %s\n", err)
+		}
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		log.Fatalf("tls-cert-file and tls-key-file must be set together\n")
+	}
+	if *tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile); err != nil {
+			log.Fatalf("Invalid tls-cert-file or tls-key-file: %s\n", err)
+		}
+	}
+	if *fixtureDir != "" {
+		if err := useFixtureDir(*fixtureDir); err != nil {
+			log.Fatalf("Error using fixture-dir: %s\n", err)
+		}
+		infof("Using fixtures from %s\n", *fixtureDir)
+	}
+	if *commandPolicyFile != "" {
+		if err := loadCommandPolicies(*commandPolicyFile); err != nil {
+			log.Fatalf("Error loading command-policy-file: %s\n", err)
+		}
+	}
+	config := collectorConfig{
+		collectOCP:                  *collectOCP,
+		collectErrorLog:             *collectErrorLog,
+		collectNamespace:            *collectNamespace,
+		verboseHelp:                 *verboseHelp,
+		smartLogNsid:                *smartLogNsid,
+		trackCounterResets:          *trackCounterResets,
+		maxDevices:                  *maxDevices,
+		temperatureScale:            *temperatureScale,
+		listNsFallback:              *listNsFallback,
+		listLayout:                  *listLayout,
+		collectNamespaceControllers: *collectNamespaceControllers,
+		collectReservations:         *collectReservations,
+		maxTempSensors:              *maxTempSensors,
+		collectPersistentEventLog:   *collectPersistentEventLog,
+		compositeAsSensor0:          *compositeAsSensor0,
+		adaptiveMaxInterval:         *adaptiveMaxInterval,
+		alwaysEmit:                  *alwaysEmit,
+		deviceLabel:                 *deviceLabel,
+		collectPowerStates:          *collectPowerStates,
+		collectQueues:               *collectQueues,
+		collectVolatileWriteCache:   *collectVolatileWriteCache,
+		collectHostMemoryBuffer:     *collectHostMemoryBuffer,
+		collectEndurance:            *collectEndurance,
+		cacheTTL:                    *cacheTTL,
+		concurrency:                 *concurrency,
+		collectFirmwareLog:          *collectFirmwareLog,
+		maxErrorLogEntries:          *maxErrorLogEntries,
+	}
+	if *extraCollectorsFile != "" {
+		config.extraCollectors, err = loadExtraCollectors(*extraCollectorsFile)
+		if err != nil {
+			log.Fatalf("Error loading extra-collectors-file: %s\n", err)
+		}
+	}
+	if *deviceAliasFile != "" {
+		config.deviceAliases, err = loadDeviceAliases(*deviceAliasFile)
+		if err != nil {
+			log.Fatalf("Error loading device-alias-file: %s\n", err)
+		}
+	}
+	if *includeDevices != "" || *excludeDevices != "" {
+		config.deviceFilter, err = newDeviceFilter(*includeDevices, *excludeDevices)
+		if err != nil {
+			log.Fatalf("Invalid %s\n", err)
+		}
+	}
+	if *healthScore || *healthScoreWeightsFile != "" {
+		weights := defaultHealthScoreWeights()
+		if *healthScoreWeightsFile != "" {
+			weights, err = loadHealthScoreWeights(*healthScoreWeightsFile)
+			if err != nil {
+				log.Fatalf("Error loading health-score-weights-file: %s\n", err)
+			}
+		}
+		config.healthScoreWeights = &weights
+	}
+	if *collectSmartOnly {
+		config = config.smartLogOnly()
+	}
+	infof("Enabled collectors: %s\n", strings.Join(config.enabledCollectors(), ", "))
+	exporter := newNvmeCollector(config)
+	if *metricExclude != "" {
+		exporter, err = newExcludeCollector(exporter, *metricExclude)
+		if err != nil {
+			log.Fatalf("Invalid metric-exclude: %s\n", err)
+		}
+	}
+	if *validateConfig {
+		printEffectiveConfig(os.Stdout, config, *listenAddress, *metricExclude, *includeDevices, *excludeDevices)
+		return
+	}
+	// check for nvme-cli executable, or nsenter to run the target's nvme-cli
+	if *nsenter != "" {
+		nsenterTarget = *nsenter
+		if _, err := exec.LookPath("nsenter"); err != nil {
+			log.Fatalf("Cannot find nsenter command in path: %s\n", err)
+		}
+	} else if _, err := exec.LookPath("nvme"); err != nil {
 		log.Fatalf("Cannot find nvme command in path: %s\n", err)
 	}
-	prometheus.MustRegister(newNvmeCollector())
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	if *sudo {
+		useSudo = true
+		if _, err := exec.LookPath("sudo"); err != nil {
+			log.Fatalf("Cannot find sudo command in path: %s\n", err)
+		}
+	}
+	// rather than requiring root, check that nvme works with the privileges
+	// the exporter has, e.g. CAP_SYS_ADMIN or a sudoers entry
+	if !*skipPrivilegeCheck {
+		if err := checkNvmeAccess(execRunner{}); err != nil {
+			if useSudo {
+				log.Fatalf("Error running nvme list with sudo -n, check the sudoers entry for nvme: %s\n", err)
+			}
+			log.Fatalf("Error running nvme list, run as root, with CAP_SYS_ADMIN or with --use-sudo: %s\n", err)
+		}
+	}
+	if *textfileOutput != "" {
+		// node_exporter exports its own go_* and process_* metrics, only
+		// the nvme metrics are written to the file
+		textfileRegistry := prometheus.NewRegistry()
+		textfileRegistry.MustRegister(exporter)
+		infof("Writing metrics to %s every %s\n", *textfileOutput, *collectInterval)
+		writeTextfile(textfileRegistry, *textfileOutput, *collectInterval)
+	}
+	registry := newRegistry(exporter)
+	// gatherer backs both /metrics and pushes
+	var gatherer prometheus.Gatherer = newMinIntervalGatherer(registry, *minScrapeInterval)
+	if *onDemand {
+		triggered := newTriggeredGatherer(registry)
+		http.Handle("/collect", collectHandler(triggered))
+		gatherer = triggered
+	}
+	if *pushGateway != "" {
+		if *pushInstance == "" {
+			*pushInstance, err = os.Hostname()
+			if err != nil {
+				log.Fatalf("Error getting hostname for push-instance: %s\n", err)
+			}
+		}
+		go pushMetrics(gatherer, *pushGateway, *pushJob, *pushInstance, *pushInterval)
+	}
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(registry, metricsHandler(gatherer)))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/", landingHandler(*temperatureScale))
+	go discoverDevices(execRunner{}, *listLayout)
+	if *tlsCertFile != "" {
+		infof("Listening on %s with tls\n", *listenAddress)
+		log.Fatal(http.ListenAndServeTLS(*listenAddress, *tlsCertFile, *tlsKeyFile, nil))
+	}
+	infof("Listening on %s\n", *listenAddress)
+	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
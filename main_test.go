@@ -0,0 +1,948 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tidwall/gjson"
+)
+
+// fakeRunner serves canned nvme output by the arguments to nvme, by the
+// subcommand and device, e.g. "id-ns /dev/nvme0n1", or by the subcommand
+// alone, and fails commands it has no output for
+type fakeRunner map[string]string
+
+func (r fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	if name != "nvme" || len(args) == 0 {
+		return nil, fmt.Errorf("unexpected command %s %s", name, strings.Join(args, " "))
+	}
+	keys := []string{strings.Join(args, " "), args[0]}
+	if len(args) > 1 {
+		keys = []string{strings.Join(args, " "), args[0] + " " + args[1], args[0]}
+	}
+	for _, key := range keys {
+		if output, ok := r[key]; ok {
+			return []byte(output), nil
+		}
+	}
+	return nil, fmt.Errorf("nvme %s is not supported", args[0])
+}
+
+// failingRunner fails the subcommands in errors with their error and serves
+// the rest from fakeRunner, counting the commands run by subcommand
+type failingRunner struct {
+	fakeRunner
+	errors map[string]error
+	runs   map[string]int
+}
+
+func (r *failingRunner) Run(name string, args ...string) ([]byte, error) {
+	if r.runs == nil {
+		r.runs = make(map[string]int)
+	}
+	r.runs[args[0]]++
+	if err, ok := r.errors[args[0]]; ok {
+		return nil, err
+	}
+	return r.fakeRunner.Run(name, args...)
+}
+
+// exitError returns the error of a command exiting with status 1 after
+// printing stderr
+func exitError(t *testing.T, stderr string) error {
+	t.Helper()
+	_, err := exec.Command("sh", "-c", `printf '%s\n' "$0" >&2; exit 1`, stderr).Output()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("expected an exit error, got %v", err)
+	}
+	return err
+}
+
+const testNvmeList = `{
+  "Devices": [{
+    "Subsystems": [{
+      "SubsystemNQN": "nqn.2019-10.com.example:test",
+      "Controllers": [{
+        "Controller": "nvme0",
+        "Transport": "pcie",
+        "Address": "0000:01:00.0",
+        "ModelNumber": "Example NVMe",
+        "SerialNumber": "S123",
+        "Firmware": "1.0",
+        "Namespaces": [{"NameSpace": "nvme0n1", "NSID": 1}]
+      }]
+    }]
+  }]
+}`
+
+// testTwoDriveNvmeList has two pcie drives with a namespace each
+const testTwoDriveNvmeList = `{"Devices": [{"Subsystems": [
+  {"SubsystemNQN": "nqn.2019-10.com.example:a", "Controllers": [
+    {"Controller": "nvme0", "Transport": "pcie", "SerialNumber": "S123", "Namespaces": [{"NameSpace": "nvme0n1", "NSID": 1}]}
+  ]},
+  {"SubsystemNQN": "nqn.2019-10.com.example:b", "Controllers": [
+    {"Controller": "nvme1", "Transport": "pcie", "SerialNumber": "S456", "Namespaces": [{"NameSpace": "nvme1n1", "NSID": 1}]}
+  ]}
+]}]}`
+
+const testIdCtrl = `{"mn": "Example NVMe", "sn": "S123", "fr": "1.0", "wctemp": 343, "cctemp": 358}`
+
+const testSmartLog = `{
+  "critical_warning": 4,
+  "temperature": 310,
+  "avail_spare": 100,
+  "spare_thresh": 10,
+  "percent_used": 3,
+  "data_units_read": 1000,
+  "data_units_written": 2000,
+  "media_errors": 0,
+  "num_err_log_entries": 7
+}`
+
+// testCollectorConfig returns the flag defaults with temperatures in celsius,
+// collecting with runner
+func testCollectorConfig(runner commandRunner) collectorConfig {
+	return collectorConfig{
+		smartLogNsid:     "auto",
+		temperatureScale: scaleCelsius,
+		maxTempSensors:   8,
+		deviceLabel:      deviceLabelNamespace,
+		concurrency:      1,
+		listLayout:       layoutAuto,
+		runner:           runner,
+	}
+}
+
+// useTestSysfs points sysfs reads at an empty directory so tests don't see
+// the drives of the machine running them
+func useTestSysfs(t *testing.T) {
+	dir := t.TempDir()
+	oldSysClassNvme, oldSysBlock := sysClassNvme, sysBlock
+	sysClassNvme, sysBlock = dir, dir
+	t.Cleanup(func() {
+		sysClassNvme, sysBlock = oldSysClassNvme, oldSysBlock
+	})
+}
+
+// gatherMetrics registers collector with a new registry and returns the
+// gathered metric families by name
+func gatherMetrics(t *testing.T, collector prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatalf("error registering collector: %s", err)
+	}
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+	families := make(map[string]*dto.MetricFamily)
+	for _, family := range metricFamilies {
+		families[family.GetName()] = family
+	}
+	return families
+}
+
+// metricValue returns the value of the metric with the given name and
+// labels, given as name and value pairs
+func metricValue(families map[string]*dto.MetricFamily, name string, labels ...string) (float64, bool) {
+	for _, metric := range families[name].GetMetric() {
+		if !hasLabels(metric, labels...) {
+			continue
+		}
+		switch {
+		case metric.Gauge != nil:
+			return metric.Gauge.GetValue(), true
+		case metric.Counter != nil:
+			return metric.Counter.GetValue(), true
+		case metric.Untyped != nil:
+			return metric.Untyped.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func hasLabels(metric *dto.Metric, labels ...string) bool {
+	values := make(map[string]string)
+	for _, pair := range metric.GetLabel() {
+		values[pair.GetName()] = pair.GetValue()
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		if values[labels[i]] != labels[i+1] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCollectWithFakeRunner(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	device := []string{"device", "/dev/nvme0n1"}
+	tests := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"nvme_up", nil, 1},
+		{"nvme_temperature", device, 36.85},
+		{"nvme_avail_spare", device, 100},
+		{"nvme_critical_warning", device, 4},
+		{"nvme_reliability_degraded", device, 1},
+		{"nvme_readonly", device, 0},
+		{"nvme_data_read_bytes_total", device, 1000 * dataUnitBytes},
+		{"nvme_num_err_log_entries", device, 7},
+		{"nvme_warning_temperature_threshold", device, 69.85},
+		{"nvme_namespace_count", []string{"controller", "nvme0"}, 1},
+		{"nvme_host_data_written_bytes_total", nil, 2000 * dataUnitBytes},
+		{"nvme_device_info", []string{"device", "/dev/nvme0n1", "model", "Example NVMe", "serial", "S123", "wwid", "nvme.S123-1"}, 1},
+	}
+	for _, test := range tests {
+		got, ok := metricValue(families, test.name, test.labels...)
+		if !ok {
+			t.Errorf("%s%v is missing", test.name, test.labels)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestCollectNvmeListFailure(t *testing.T) {
+	useTestSysfs(t)
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{})))
+	if got, _ := metricValue(families, "nvme_up"); got != 0 {
+		t.Errorf("nvme_up = %v, want 0", got)
+	}
+	if _, ok := families["nvme_temperature"]; ok {
+		t.Errorf("nvme_temperature exported without devices")
+	}
+}
+
+func TestThermalManagementMapping(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":    testNvmeList,
+		"id-ctrl": testIdCtrl,
+		"smart-log": `{
+  "temperature": 310,
+  "thm_temp1_trans_count": 11,
+  "thm_temp2_trans_count": 12,
+  "thm_temp1_total_time": 21,
+  "thm_temp2_total_time": 22,
+  "thm_temp3_total_time": 99
+}`,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	tests := map[string]float64{
+		"nvme_thm_temp1_trans_count": 11,
+		"nvme_thm_temp2_trans_count": 12,
+		"nvme_thm_temp1_trans_time":  21,
+		"nvme_thm_temp2_trans_time":  22,
+	}
+	for name, want := range tests {
+		if got, _ := metricValue(families, name, "device", "/dev/nvme0n1"); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestValidateConfigMain runs main with the flags in NVME_EXPORTER_ARGS when
+// TestValidateConfig runs the test binary as a helper process
+func TestValidateConfigMain(t *testing.T) {
+	args := os.Getenv("NVME_EXPORTER_ARGS")
+	if args == "" {
+		t.Skip("only run as a helper process of TestValidateConfig")
+	}
+	os.Args = append([]string{"nvme_exporter"}, strings.Split(args, "\n")...)
+	main()
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	weights := filepath.Join(dir, "weights.json")
+	if err := ioutil.WriteFile(weights, []byte(`{"wear": -1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		valid bool
+		want  []string
+	}{
+		{"defaults", nil, true, []string{
+			"listen address: :9998",
+			"collectors: smart_log\n",
+			"excluded metrics: (none)",
+		}},
+		{"resolved", []string{"--listen-address=127.0.0.1:9100", "--collect-ocp", "--collect-queues", "--metric-exclude=nvme_thm_.*", "--include-devices=/dev/nvme[0-9]+n1", "--exclude-devices=/dev/nvme9n1"}, true, []string{
+			"listen address: 127.0.0.1:9100",
+			"collectors: ocp, queues, smart_log\n",
+			"excluded metrics: nvme_thm_.*",
+			"include devices: /dev/nvme[0-9]+n1",
+			"exclude devices: /dev/nvme9n1",
+		}},
+		{"smart-log only", []string{"--collect-ocp", "--collect-smart-only"}, true, []string{
+			"collectors: smart_log\n",
+		}},
+		{"invalid metric-exclude", []string{"--metric-exclude=nvme_(", "--collect-ocp"}, false, []string{"Invalid metric-exclude"}},
+		{"invalid device filter", []string{"--include-devices=[nvme"}, false, []string{"Invalid include-devices"}},
+		{"invalid temperature scale", []string{"--temperature-scale=rankine"}, false, []string{"Invalid temperature-scale"}},
+		{"invalid listen address", []string{"--listen-address=localhost"}, false, []string{"Invalid listen-address"}},
+		{"missing file", []string{"--device-alias-file=" + filepath.Join(dir, "missing.json")}, false, []string{"Error loading device-alias-file"}},
+		{"invalid weights", []string{"--health-score-weights-file=" + weights}, false, []string{"Error loading health-score-weights-file"}},
+	}
+	for _, test := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestValidateConfigMain$")
+		cmd.Env = append(os.Environ(), "NVME_EXPORTER_ARGS="+strings.Join(append([]string{"--validate-config"}, test.args...), "\n"))
+		output, err := cmd.CombinedOutput()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: valid = %v, want %v: %s\n%s", test.name, valid, test.valid, err, output)
+			continue
+		}
+		if test.valid && !strings.Contains(string(output), "Configuration is valid") {
+			t.Errorf("%s: output doesn't report a valid configuration:\n%s", test.name, output)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(string(output), want) {
+				t.Errorf("%s: output doesn't contain %q:\n%s", test.name, want, output)
+			}
+		}
+	}
+}
+
+// testDiscoveryNvmeList has a tcp discovery controller next to a pcie drive
+const testDiscoveryNvmeList = `{"Devices": [{"Subsystems": [
+  {"SubsystemNQN": "nqn.2014-08.org.nvmexpress.discovery", "Controllers": [
+    {"Controller": "nvme1", "Transport": "tcp", "Address": "traddr=10.50.4.15,trsvcid=8009,src_addr=10.50.4.2"}
+  ]},
+  {"SubsystemNQN": "nqn.2019-10.com.example:test", "Controllers": [
+    {"Controller": "nvme0", "Transport": "pcie", "Namespaces": [{"NameSpace": "nvme0n1", "NSID": 1}]}
+  ]}
+]}]}`
+
+func TestDiscoveryController(t *testing.T) {
+	useTestSysfs(t)
+	if err := os.MkdirAll(filepath.Join(sysClassNvme, "nvme1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for attr, value := range map[string]string{"state": "live\n", "cntrltype": "discovery\n"} {
+		if err := ioutil.WriteFile(filepath.Join(sysClassNvme, "nvme1", attr), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runner := fakeRunner{
+		"list":      testDiscoveryNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	collector := newNvmeCollector(testCollectorConfig(runner))
+	families := gatherMetrics(t, collector)
+	got, ok := metricValue(families, "nvme_discovery_controller_up", "controller", "nvme1", "address", "10.50.4.15:8009")
+	if !ok {
+		t.Fatalf("nvme_discovery_controller_up{address=\"10.50.4.15:8009\"} is missing: %v", families["nvme_discovery_controller_up"])
+	}
+	if got != 1 {
+		t.Errorf("nvme_discovery_controller_up = %v for a live controller, want 1", got)
+	}
+	if got, ok := metricValue(families, "nvme_fabric_connection_info", "controller", "nvme1", "transport", "tcp", "address", "10.50.4.15:8009"); !ok || got != 1 {
+		t.Errorf("nvme_fabric_connection_info = %v, %v, want 1", got, ok)
+	}
+	// pcie controllers aren't fabrics connections
+	if n := len(families["nvme_fabric_connection_info"].GetMetric()); n != 1 {
+		t.Errorf("nvme_fabric_connection_info has %d series, want 1", n)
+	}
+	// discovery controllers have no smart-log
+	if _, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); !ok {
+		t.Errorf("nvme_temperature of the pcie drive is missing")
+	}
+	if n := len(families["nvme_temperature"].GetMetric()); n != 1 {
+		t.Errorf("nvme_temperature has %d series, want 1", n)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sysClassNvme, "nvme1", "state"), []byte("connecting\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	families = gatherMetrics(t, collector)
+	if got, _ := metricValue(families, "nvme_discovery_controller_up", "controller", "nvme1", "address", "10.50.4.15:8009"); got != 0 {
+		t.Errorf("nvme_discovery_controller_up = %v for a connecting controller, want 0", got)
+	}
+}
+
+func TestTemperatureSensor0HelpUsesPrefix(t *testing.T) {
+	useTestSysfs(t)
+	oldPrefix := metricPrefix
+	metricPrefix = "team_nvme"
+	defer func() { metricPrefix = oldPrefix }()
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	config.compositeAsSensor0 = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	family, ok := families["team_nvme_temperature_sensor0"]
+	if !ok {
+		t.Fatalf("team_nvme_temperature_sensor0 is missing")
+	}
+	if help := family.GetHelp(); !strings.HasSuffix(help, "same as team_nvme_temperature") {
+		t.Errorf("team_nvme_temperature_sensor0 help %q doesn't refer to team_nvme_temperature", help)
+	}
+	if got, _ := metricValue(families, "team_nvme_temperature_sensor0", "device", "/dev/nvme0n1"); got != 36.85 {
+		t.Errorf("team_nvme_temperature_sensor0 = %v, want 36.85", got)
+	}
+}
+
+func TestVerboseHelp(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	for _, verbose := range []bool{false, true} {
+		config := testCollectorConfig(runner)
+		config.verboseHelp = verbose
+		families := gatherMetrics(t, newNvmeCollector(config))
+		for _, name := range []string{"nvme_temperature", "nvme_media_errors", "nvme_percent_used"} {
+			help := families[name].GetHelp()
+			if got := strings.HasSuffix(help, smartLogSpecReference); got != verbose {
+				t.Errorf("verbose-help %v: %s help %q references the spec = %v", verbose, name, help, got)
+			}
+		}
+		// metrics not read from smart-log have no reference
+		if help := families["nvme_up"].GetHelp(); strings.Contains(help, smartLogSpecReference) {
+			t.Errorf("verbose-help %v: nvme_up help %q references the smart-log section", verbose, help)
+		}
+	}
+}
+
+func TestParseCriticalWarning(t *testing.T) {
+	tests := []struct {
+		json string
+		want float64
+	}{
+		{`{"critical_warning": 5}`, 5},
+		{`{"critical_warning": "0x05"}`, 5},
+		{`{"critical_warning": " 0x1f "}`, 31},
+		{`{"critical_warning": "4"}`, 4},
+		{`{"critical_warning": {"value": 5, "available_spare": 1}}`, 5},
+		{`{"critical_warning": {"value": "0x08"}}`, 8},
+		{`{"critical_warning": "not a number"}`, 0},
+		{`{}`, 0},
+	}
+	for _, test := range tests {
+		if got := parseCriticalWarning(gjson.Get(test.json, "critical_warning")); got != test.want {
+			t.Errorf("parseCriticalWarning(%s) = %v, want %v", test.json, got, test.want)
+		}
+	}
+}
+
+func TestCriticalWarningHexString(t *testing.T) {
+	useTestSysfs(t)
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"critical_warning": "0x05", "temperature": 310}`,
+	})))
+	tests := map[string]float64{
+		"nvme_critical_warning":            5,
+		"nvme_avail_spare_below_threshold": 1,
+		"nvme_temp_threshold_exceeded":     0,
+		"nvme_reliability_degraded":        1,
+		"nvme_readonly":                    0,
+	}
+	for name, want := range tests {
+		if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, ok, want)
+		}
+	}
+}
+
+func TestSmartLogNsid(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":                           testNvmeList,
+		"id-ctrl":                        testIdCtrl,
+		"smart-log /dev/nvme0n1 -o json": `{"temperature": 300}`,
+		"smart-log /dev/nvme0n1 -o json -n 0xffffffff": `{"temperature": 310}`,
+	}
+	tests := []struct {
+		nsid string
+		want float64
+	}{
+		// auto leaves the namespace to nvme-cli
+		{"auto", 26.85},
+		{"0xffffffff", 36.85},
+	}
+	for _, test := range tests {
+		config := testCollectorConfig(runner)
+		config.smartLogNsid = test.nsid
+		families := gatherMetrics(t, newNvmeCollector(config))
+		if got, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); !ok || got != test.want {
+			t.Errorf("smart-log-nsid %s: nvme_temperature = %v, %v, want %v", test.nsid, got, ok, test.want)
+		}
+	}
+}
+
+func TestHostDataBytes(t *testing.T) {
+	useTestSysfs(t)
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":                   testTwoDriveNvmeList,
+		"id-ctrl":                testIdCtrl,
+		"smart-log /dev/nvme0n1": `{"data_units_read": 1000, "data_units_written": 2000}`,
+		"smart-log /dev/nvme1n1": `{"data_units_read": 30, "data_units_written": 40}`,
+	})))
+	tests := []struct {
+		name string
+		want float64
+	}{
+		{"nvme_host_data_read_bytes_total", 1030 * dataUnitBytes},
+		{"nvme_host_data_written_bytes_total", 2040 * dataUnitBytes},
+	}
+	for _, test := range tests {
+		if got, ok := metricValue(families, test.name); !ok || got != test.want {
+			t.Errorf("%s = %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestMaxDevices(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testTwoDriveNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	config.maxDevices = 1
+	collector := newNvmeCollector(config)
+	families := gatherMetrics(t, collector)
+	// devices are collected in path order
+	if _, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); !ok {
+		t.Errorf("nvme_temperature of /dev/nvme0n1 is missing")
+	}
+	if n := len(families["nvme_temperature"].GetMetric()); n != 1 {
+		t.Errorf("nvme_temperature has %d series with max-devices 1, want 1", n)
+	}
+	if got, _ := metricValue(families, "nvme_devices_skipped_total"); got != 1 {
+		t.Errorf("nvme_devices_skipped_total = %v, want 1", got)
+	}
+	families = gatherMetrics(t, collector)
+	if got, _ := metricValue(families, "nvme_devices_skipped_total"); got != 2 {
+		t.Errorf("nvme_devices_skipped_total = %v after two scrapes, want 2", got)
+	}
+}
+
+func TestOverCriticalTemp(t *testing.T) {
+	useTestSysfs(t)
+	// cctemp of testIdCtrl is 358 K
+	tests := []struct {
+		temperature string
+		want        float64
+	}{
+		{"357", 0},
+		{"358", 1},
+		{"370", 1},
+	}
+	for _, test := range tests {
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+			"list":      testNvmeList,
+			"id-ctrl":   testIdCtrl,
+			"smart-log": `{"temperature": ` + test.temperature + `}`,
+		})))
+		if got, ok := metricValue(families, "nvme_over_critical_temp", "device", "/dev/nvme0n1"); !ok || got != test.want {
+			t.Errorf("temperature %s K: nvme_over_critical_temp = %v, %v, want %v", test.temperature, got, ok, test.want)
+		}
+	}
+	// controllers without a critical threshold don't report it
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   `{"sn": "S123"}`,
+		"smart-log": testSmartLog,
+	})))
+	if _, ok := families["nvme_over_critical_temp"]; ok {
+		t.Errorf("nvme_over_critical_temp exported without cctemp")
+	}
+}
+
+func TestCollectorEnabled(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	config.collectOCP = true
+	config.collectPowerStates = true
+	if got, want := strings.Join(config.enabledCollectors(), ","), "ocp,power_states,smart_log"; got != want {
+		t.Errorf("enabledCollectors() = %s, want %s", got, want)
+	}
+	families := gatherMetrics(t, newNvmeCollector(config))
+	tests := map[string]float64{
+		"smart_log":    1,
+		"ocp":          1,
+		"power_states": 1,
+		"error_log":    0,
+		"namespace":    0,
+		"endurance":    0,
+	}
+	for collector, want := range tests {
+		if got, ok := metricValue(families, "nvme_collector_enabled", "collector", collector); !ok || got != want {
+			t.Errorf("nvme_collector_enabled{collector=%q} = %v, %v, want %v", collector, got, ok, want)
+		}
+	}
+	// collect-smart-only disables every other group
+	if got := strings.Join(config.smartLogOnly().enabledCollectors(), ","); got != "smart_log" {
+		t.Errorf("enabledCollectors() with collect-smart-only = %s, want smart_log", got)
+	}
+}
+
+func TestRegistryExportsRuntimeMetrics(t *testing.T) {
+	useTestSysfs(t)
+	registry := newRegistry(newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})))
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+	found := make(map[string]bool)
+	for _, family := range metricFamilies {
+		found[family.GetName()] = true
+	}
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "nvme_up"} {
+		if !found[name] {
+			t.Errorf("%s is missing from the gathered metrics", name)
+		}
+	}
+}
+
+func TestCriticalWarningReadonly(t *testing.T) {
+	useTestSysfs(t)
+	tests := []struct {
+		criticalWarning    string
+		readonly, degraded float64
+	}{
+		{"0", 0, 0},
+		{"4", 0, 1},
+		{"8", 1, 0},
+		{"12", 1, 1},
+	}
+	for _, test := range tests {
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+			"list":      testNvmeList,
+			"id-ctrl":   testIdCtrl,
+			"smart-log": `{"critical_warning": ` + test.criticalWarning + `, "temperature": 310}`,
+		})))
+		if got, _ := metricValue(families, "nvme_readonly", "device", "/dev/nvme0n1"); got != test.readonly {
+			t.Errorf("critical_warning %s: nvme_readonly = %v, want %v", test.criticalWarning, got, test.readonly)
+		}
+		if got, _ := metricValue(families, "nvme_reliability_degraded", "device", "/dev/nvme0n1"); got != test.degraded {
+			t.Errorf("critical_warning %s: nvme_reliability_degraded = %v, want %v", test.criticalWarning, got, test.degraded)
+		}
+	}
+}
+
+func TestSmartLogOncePerController(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list": `{"Devices": [{"Subsystems": [{"SubsystemNQN": "nqn.2019-10.com.example:test", "Controllers": [{
+  "Controller": "nvme0",
+  "Namespaces": [{"NameSpace": "nvme0n1", "NSID": 1}, {"NameSpace": "nvme0n2", "NSID": 2}]
+}]}]}]}`,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if n := len(families["nvme_data_units_read"].GetMetric()); n != 1 {
+		t.Errorf("nvme_data_units_read has %d series for one controller, want 1", n)
+	}
+	if got, _ := metricValue(families, "nvme_host_data_read_bytes_total"); got != 1000*dataUnitBytes {
+		t.Errorf("nvme_host_data_read_bytes_total = %v, want the controller's %v", got, 1000*dataUnitBytes)
+	}
+	if got, _ := metricValue(families, "nvme_namespace_count", "controller", "nvme0"); got != 2 {
+		t.Errorf("nvme_namespace_count = %v, want 2", got)
+	}
+}
+
+func TestLockedDrive(t *testing.T) {
+	useTestSysfs(t)
+	restoreCommandPolicies(t)
+	commandPolicies["smart-log"] = commandPolicy{Retries: 2, SkipDevice: true}
+	runner := &failingRunner{
+		fakeRunner: fakeRunner{
+			"list":    testNvmeList,
+			"id-ctrl": testIdCtrl,
+		},
+		errors: map[string]error{
+			"smart-log": exitError(t, "NVMe status: Access Denied: Access to the namespace and/or LBA range is denied due to lack of access rights(0x4286)"),
+		},
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if got, ok := metricValue(families, "nvme_drive_locked", "device", "/dev/nvme0n1"); !ok || got != 1 {
+		t.Errorf("nvme_drive_locked = %v, %v, want 1", got, ok)
+	}
+	// locked drives skip the smart-log metrics without retrying, even when
+	// the policy retries smart-log
+	if _, ok := families["nvme_temperature"]; ok {
+		t.Errorf("nvme_temperature exported for a locked drive")
+	}
+	if n := runner.runs["smart-log"]; n != 1 {
+		t.Errorf("smart-log ran %d times for a locked drive, want 1", n)
+	}
+
+	delete(runner.errors, "smart-log")
+	runner.fakeRunner["smart-log"] = testSmartLog
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if got, ok := metricValue(families, "nvme_drive_locked", "device", "/dev/nvme0n1"); !ok || got != 0 {
+		t.Errorf("nvme_drive_locked = %v, %v after unlocking, want 0", got, ok)
+	}
+}
+
+func TestIsLockedError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"access denied", exitError(t, "NVMe status: Access Denied: Access to the namespace and/or LBA range is denied due to lack of access rights(0x4286)"), true},
+		{"access denied without dnr", exitError(t, "NVMe status: Access Denied: Access to the namespace and/or LBA range is denied due to lack of access rights(0x286)"), true},
+		{"operation denied", exitError(t, "NVMe status: Operation Denied: The command was denied due to lack of access rights(0x4015)"), true},
+		// only the status counts, not other mentions of a lock
+		{"locked", exitError(t, "Error: the drive is Locked"), false},
+		{"permission denied", exitError(t, "open: Permission denied, access denied"), false},
+		{"other failure", exitError(t, "NVMe status: Invalid Field in Command(0x4002)"), false},
+		{"not an exit error", fmt.Errorf("access denied"), false},
+		{"no error", nil, false},
+	}
+	for _, test := range tests {
+		if got := isLockedError(test.err); got != test.want {
+			t.Errorf("%s: isLockedError() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSmartOnlyRunsSmartLog(t *testing.T) {
+	useTestSysfs(t)
+	runner := &failingRunner{fakeRunner: fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+		"id-ns":     `{"nsze": 1953525168}`,
+	}}
+	config := testCollectorConfig(runner)
+	config.collectOCP = true
+	config.collectErrorLog = true
+	config.collectNamespace = true
+	config.collectNamespaceControllers = true
+	config.collectReservations = true
+	config.collectPersistentEventLog = true
+	config.collectPowerStates = true
+	config.collectQueues = true
+	config.collectVolatileWriteCache = true
+	config.collectHostMemoryBuffer = true
+	config.collectFirmwareLog = true
+	config.collectEndurance = true
+	families := gatherMetrics(t, newNvmeCollector(config.smartLogOnly()))
+	for subcommand, n := range runner.runs {
+		if subcommand != "list" && subcommand != "smart-log" {
+			t.Errorf("nvme %s ran %d times with collect-smart-only", subcommand, n)
+		}
+	}
+	if n := runner.runs["smart-log"]; n != 1 {
+		t.Errorf("smart-log ran %d times, want 1", n)
+	}
+	if got, _ := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); got != 36.85 {
+		t.Errorf("nvme_temperature = %v, want 36.85", got)
+	}
+	if _, ok := families["nvme_device_info"]; ok {
+		t.Errorf("nvme_device_info exported with collect-smart-only")
+	}
+}
+
+func TestHostAnyCriticalWarning(t *testing.T) {
+	useTestSysfs(t)
+	tests := []struct {
+		name               string
+		warning0, warning1 string
+		want               float64
+	}{
+		{"all healthy", "0", "0", 0},
+		{"one warning", "0", "4", 1},
+		{"old nvme-cli hex string", `"0x10"`, "0", 1},
+		{"all warning", "1", "8", 1},
+	}
+	for _, test := range tests {
+		runner := fakeRunner{
+			"list":                   testTwoDriveNvmeList,
+			"id-ctrl":                testIdCtrl,
+			"smart-log /dev/nvme0n1": `{"critical_warning": ` + test.warning0 + `, "temperature": 310}`,
+			"smart-log /dev/nvme1n1": `{"critical_warning": ` + test.warning1 + `, "temperature": 310}`,
+		}
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+		if got, ok := metricValue(families, "nvme_host_any_critical_warning"); !ok || got != test.want {
+			t.Errorf("%s: nvme_host_any_critical_warning = %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestDeviceLabel(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testTwoDriveNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}
+	tests := []struct {
+		deviceLabel string
+		want        []string
+	}{
+		{deviceLabelNamespace, []string{"/dev/nvme0n1", "/dev/nvme1n1"}},
+		{deviceLabelController, []string{"nvme0", "nvme1"}},
+	}
+	for _, test := range tests {
+		config := testCollectorConfig(runner)
+		config.deviceLabel = test.deviceLabel
+		families := gatherMetrics(t, newNvmeCollector(config))
+		for _, device := range test.want {
+			for _, name := range []string{"nvme_temperature", "nvme_critical_warning", "nvme_data_units_read"} {
+				if _, ok := metricValue(families, name, "device", device); !ok {
+					t.Errorf("%s: %s{device=%q} is missing", test.deviceLabel, name, device)
+				}
+			}
+		}
+		// namespace metrics keep the namespace label
+		for _, device := range []string{"/dev/nvme0n1", "/dev/nvme1n1"} {
+			if _, ok := metricValue(families, "nvme_device_info", "device", device); !ok {
+				t.Errorf("%s: nvme_device_info{device=%q} is missing", test.deviceLabel, device)
+			}
+		}
+	}
+}
+
+func TestCollectWorkersAndQueueDepth(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testTwoDriveNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		newNvmeCollector(config).Describe(descs)
+		close(descs)
+	}()
+	described := make(map[string]bool)
+	for desc := range descs {
+		if m := descNameRegexp.FindStringSubmatch(desc.String()); m != nil {
+			described[m[1]] = true
+		}
+	}
+	for _, name := range []string{"nvme_collect_workers", "nvme_collect_queue_depth"} {
+		if !described[name] {
+			t.Errorf("%s isn't described", name)
+		}
+	}
+	for _, concurrency := range []int{1, 4} {
+		config.concurrency = concurrency
+		families := gatherMetrics(t, newNvmeCollector(config))
+		// the configured concurrency is exported even with fewer devices
+		if got, ok := metricValue(families, "nvme_collect_workers"); !ok || got != float64(concurrency) {
+			t.Errorf("concurrency %d: nvme_collect_workers = %v, %v, want %d", concurrency, got, ok, concurrency)
+		}
+		// how many devices wait depends on scheduling, never more than queued
+		if got, ok := metricValue(families, "nvme_collect_queue_depth"); !ok || got < 0 || got > 2 {
+			t.Errorf("concurrency %d: nvme_collect_queue_depth = %v, %v, want between 0 and 2", concurrency, got, ok)
+		}
+	}
+	// without workers every queued device is still pending
+	namespaces := []nvmeNamespace{{DevicePath: "/dev/nvme0n1"}, {DevicePath: "/dev/nvme1n1"}}
+	if _, queueDepth := newNvmeCollector(config).(*nvmeCollector).collectSmartLogs(nil, namespaces, nil, 0); queueDepth != 2 {
+		t.Errorf("queue depth without workers = %d, want 2", queueDepth)
+	}
+}
+
+func TestCriticalWarningBits(t *testing.T) {
+	useTestSysfs(t)
+	bits := []string{
+		"nvme_avail_spare_below_threshold",
+		"nvme_temp_threshold_exceeded",
+		"nvme_reliability_degraded",
+		"nvme_readonly",
+		"nvme_vmbu_failed",
+		"nvme_pmr_readonly",
+	}
+	tests := []struct {
+		criticalWarning string
+		set             map[string]bool
+	}{
+		{"4", map[string]bool{"nvme_reliability_degraded": true}},
+		{"0", map[string]bool{}},
+		{"48", map[string]bool{"nvme_vmbu_failed": true, "nvme_pmr_readonly": true}},
+		{"63", map[string]bool{"nvme_avail_spare_below_threshold": true, "nvme_temp_threshold_exceeded": true, "nvme_reliability_degraded": true, "nvme_readonly": true, "nvme_vmbu_failed": true, "nvme_pmr_readonly": true}},
+		// newer nvme-cli releases decode the bits next to the raw value
+		{`{"value": 4, "available_spare": 0, "temp_threshold": 0, "reliability_degraded": 1}`, map[string]bool{"nvme_reliability_degraded": true}},
+	}
+	for _, test := range tests {
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+			"list":      testNvmeList,
+			"id-ctrl":   testIdCtrl,
+			"smart-log": `{"critical_warning": ` + test.criticalWarning + `, "temperature": 310}`,
+		})))
+		for _, name := range bits {
+			want := 0.0
+			if test.set[name] {
+				want = 1
+			}
+			if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+				t.Errorf("critical_warning %s: %s = %v, %v, want %v", test.criticalWarning, name, got, ok, want)
+			}
+		}
+	}
+}
+
+func TestDataBytesLargeValues(t *testing.T) {
+	useTestSysfs(t)
+	tests := []struct {
+		name      string
+		dataUnits string
+		want      uint64
+	}{
+		{"over 32 bits", `12345678901`, 12345678901 * dataUnitBytes},
+		// past 2^53 bytes, exact since it's a multiple of a power of two
+		{"large", `1099511627776`, 1099511627776 * dataUnitBytes},
+		// nvme-cli releases with 128-bit counters print them as strings
+		{"string", `"12345678901"`, 12345678901 * dataUnitBytes},
+	}
+	for _, test := range tests {
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+			"list":      testNvmeList,
+			"id-ctrl":   testIdCtrl,
+			"smart-log": `{"temperature": 310, "data_units_read": ` + test.dataUnits + `, "data_units_written": ` + test.dataUnits + `}`,
+		})))
+		for _, name := range []string{"nvme_data_read_bytes_total", "nvme_data_written_bytes_total"} {
+			got, ok := metricValue(families, name, "device", "/dev/nvme0n1")
+			if !ok || got != float64(test.want) {
+				t.Errorf("%s: %s = %v, %v, want %v", test.name, name, got, ok, test.want)
+			}
+		}
+		// the original data unit counters are kept
+		if got, _ := metricValue(families, "nvme_data_units_read", "device", "/dev/nvme0n1"); got*dataUnitBytes != float64(test.want) {
+			t.Errorf("%s: nvme_data_units_read = %v, want %v", test.name, got, float64(test.want)/dataUnitBytes)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// Export per-namespace metrics from nvme id-ns
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type namespaceCollector struct {
+	nvmeNamespaceEnduranceGroup    *prometheus.Desc
+	nvmeNamespaceProtectionInfo    *prometheus.Desc
+	nvmeNamespaceProtectionEnabled *prometheus.Desc
+	nvmeNamespaceWriteProtected    *prometheus.Desc
+	nvmeNamespaceOptimalIOBoundary *prometheus.Desc
+	nvmeNamespaceWriteGranularity  *prometheus.Desc
+	nvmeNamespaceWriteAlignment    *prometheus.Desc
+	nvmeNamespaceOptimalWriteSize  *prometheus.Desc
+	runner                         commandRunner
+}
+
+func newNamespaceCollector(runner commandRunner) *namespaceCollector {
+	return &namespaceCollector{
+		nvmeNamespaceEnduranceGroup: prometheus.NewDesc(
+			metricName("namespace_endurance_group"),
+			"Endurance group the namespace belongs to, always 1",
+			[]string{"device", "endgid"},
+			nil,
+		),
+		nvmeNamespaceProtectionInfo: prometheus.NewDesc(
+			metricName("namespace_protection_info"),
+			"End-to-end data protection type of the namespace (dps bits 2:0), always 1",
+			[]string{"device", "type"},
+			nil,
+		),
+		nvmeNamespaceProtectionEnabled: prometheus.NewDesc(
+			metricName("namespace_protection_enabled"),
+			"Whether end-to-end data protection information (T10 DIF) is enabled for the namespace",
+			labels,
+			nil,
+		),
+		nvmeNamespaceWriteProtected: prometheus.NewDesc(
+			metricName("namespace_write_protected"),
+			"Whether the namespace is write protected, including until the next power cycle or permanently (get-feature 0x84)",
+			labels,
+			nil,
+		),
+		nvmeNamespaceOptimalIOBoundary: prometheus.NewDesc(
+			metricName("namespace_optimal_io_boundary_blocks"),
+			"Optimal I/O boundary of the namespace in logical blocks (noiob), I/O shouldn't cross it",
+			labels,
+			nil,
+		),
+		nvmeNamespaceWriteGranularity: prometheus.NewDesc(
+			metricName("namespace_preferred_write_granularity_blocks"),
+			"Preferred write granularity of the namespace in logical blocks (npwg)",
+			labels,
+			nil,
+		),
+		nvmeNamespaceWriteAlignment: prometheus.NewDesc(
+			metricName("namespace_preferred_write_alignment_blocks"),
+			"Preferred write alignment of the namespace in logical blocks (npwa)",
+			labels,
+			nil,
+		),
+		nvmeNamespaceOptimalWriteSize: prometheus.NewDesc(
+			metricName("namespace_optimal_write_size_blocks"),
+			"Optimal write size of the namespace in logical blocks (nows)",
+			labels,
+			nil,
+		),
+		runner: runner,
+	}
+}
+
+func (c *namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeNamespaceEnduranceGroup
+	ch <- c.nvmeNamespaceProtectionInfo
+	ch <- c.nvmeNamespaceProtectionEnabled
+	ch <- c.nvmeNamespaceWriteProtected
+	ch <- c.nvmeNamespaceOptimalIOBoundary
+	ch <- c.nvmeNamespaceWriteGranularity
+	ch <- c.nvmeNamespaceWriteAlignment
+	ch <- c.nvmeNamespaceOptimalWriteSize
+}
+
+func (c *namespaceCollector) collect(ch chan<- prometheus.Metric, nvmeDevice string) {
+	nvmeIdNs, err := runNvmeJSON(c.runner, "id-ns", nvmeDevice, "-o", "json")
+	if err != nil {
+		warnf("Skipping namespace metrics for device %s: %s\n", nvmeDevice, err)
+		return
+	}
+	if !gjson.ValidBytes(nvmeIdNs) {
+		warnf("Skipping namespace metrics for device %s: id-ns json is not valid\n", nvmeDevice)
+		return
+	}
+	idNs := gjson.ParseBytes(nvmeIdNs)
+	// endgid is 0 when the drive doesn't support endurance groups
+	if endgid := idNs.Get("endgid"); endgid.Uint() != 0 {
+		ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceEnduranceGroup, prometheus.GaugeValue, 1, nvmeDevice, endgid.String())
+	}
+	protectionType := idNs.Get("dps").Uint() & 7
+	protectionEnabled := 0.0
+	if protectionType != 0 {
+		protectionEnabled = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceProtectionInfo, prometheus.GaugeValue, 1, nvmeDevice, protectionTypeName(protectionType))
+	ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceProtectionEnabled, prometheus.GaugeValue, protectionEnabled, nvmeDevice)
+	// noiob is 0 when not reported
+	if noiob := idNs.Get("noiob").Float(); noiob != 0 {
+		ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceOptimalIOBoundary, prometheus.GaugeValue, noiob, nvmeDevice)
+	}
+	// the preferred write fields are 0's based and only valid when nsfeat
+	// bit 4 (optperf) is set
+	if idNs.Get("nsfeat").Uint()>>4&1 == 1 {
+		ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceWriteGranularity, prometheus.GaugeValue, idNs.Get("npwg").Float()+1, nvmeDevice)
+		ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceWriteAlignment, prometheus.GaugeValue, idNs.Get("npwa").Float()+1, nvmeDevice)
+		ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceOptimalWriteSize, prometheus.GaugeValue, idNs.Get("nows").Float()+1, nvmeDevice)
+	}
+	c.collectWriteProtection(ch, nvmeDevice)
+}
+
+func (c *namespaceCollector) collectWriteProtection(ch chan<- prometheus.Metric, nvmeDevice string) {
+	nsid := namespaceID(nvmeDevice)
+	if nsid == "" {
+		return
+	}
+	value, err := getFeature(c.runner, nvmeDevice, 0x84, featureSelectCurrent, "-n", nsid)
+	if err != nil {
+		warnf("Skipping write protection for device %s: %s\n", nvmeDevice, err)
+		return
+	}
+	// bits 2:0 are the write protection state, 0 is not write protected
+	writeProtected := 0.0
+	if value&7 != 0 {
+		writeProtected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceWriteProtected, prometheus.GaugeValue, writeProtected, nvmeDevice)
+}
+
+// protectionTypeName names the protection information type in dps bits 2:0
+func protectionTypeName(dps uint64) string {
+	if dps == 0 {
+		return "none"
+	}
+	return "type" + strconv.FormatUint(dps, 10)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherNamespaceMetrics collects the test drive with the namespace
+// collector enabled and idNs as its id-ns output
+func gatherNamespaceMetrics(t *testing.T, idNs string) map[string]*dto.MetricFamily {
+	t.Helper()
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+		"id-ns":     idNs,
+	})
+	config.collectNamespace = true
+	return gatherMetrics(t, newNvmeCollector(config))
+}
+
+func TestNamespaceEnduranceGroup(t *testing.T) {
+	families := gatherNamespaceMetrics(t, `{"nsze": 1953525168, "endgid": 2}`)
+	if got, ok := metricValue(families, "nvme_namespace_endurance_group", "device", "/dev/nvme0n1", "endgid", "2"); !ok || got != 1 {
+		t.Errorf("nvme_namespace_endurance_group{endgid=\"2\"} = %v, %v, want 1", got, ok)
+	}
+	// drives without endurance groups report endgid 0
+	families = gatherNamespaceMetrics(t, `{"nsze": 1953525168, "endgid": 0}`)
+	if _, ok := families["nvme_namespace_endurance_group"]; ok {
+		t.Errorf("nvme_namespace_endurance_group exported for endgid 0")
+	}
+}
+
+func TestNamespaceProtectionInfo(t *testing.T) {
+	tests := []struct {
+		idNs    string
+		typ     string
+		enabled float64
+	}{
+		// type 1 with the protection information in the first 8 bytes
+		{`{"nsze": 1953525168, "dps": 9}`, "type1", 1},
+		{`{"nsze": 1953525168, "dps": 3}`, "type3", 1},
+		// bit 3 alone is the location of the protection information
+		{`{"nsze": 1953525168, "dps": 8}`, "none", 0},
+		{`{"nsze": 1953525168}`, "none", 0},
+	}
+	for _, test := range tests {
+		families := gatherNamespaceMetrics(t, test.idNs)
+		if got, ok := metricValue(families, "nvme_namespace_protection_info", "device", "/dev/nvme0n1", "type", test.typ); !ok || got != 1 {
+			t.Errorf("%s: nvme_namespace_protection_info{type=%q} = %v, %v, want 1", test.idNs, test.typ, got, ok)
+		}
+		if got, ok := metricValue(families, "nvme_namespace_protection_enabled", "device", "/dev/nvme0n1"); !ok || got != test.enabled {
+			t.Errorf("%s: nvme_namespace_protection_enabled = %v, %v, want %v", test.idNs, got, ok, test.enabled)
+		}
+	}
+}
+
+func TestNamespaceWriteProtected(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   float64
+	}{
+		{"no write protect", "get-feature:0x84 (Namespace Write Protection Config), Current value:0x00000000\n", 0},
+		{"write protect", "get-feature:0x84 (Namespace Write Protection Config), Current value:0x00000001\n", 1},
+		{"until power cycle", "get-feature:0x84 (Namespace Write Protection Config), Current value:0x00000002\n", 1},
+		{"permanent", "get-feature:0x84 (Namespace Write Protection Config), Current value:0x00000003\n", 1},
+	}
+	for _, test := range tests {
+		useTestSysfs(t)
+		config := testCollectorConfig(fakeRunner{
+			"list":      testNvmeList,
+			"id-ctrl":   testIdCtrl,
+			"smart-log": testSmartLog,
+			"id-ns":     `{"nsze": 1953525168}`,
+			"get-feature /dev/nvme0n1 -f 132 -s 0 -n 1": test.output,
+		})
+		config.collectNamespace = true
+		families := gatherMetrics(t, newNvmeCollector(config))
+		if got, ok := metricValue(families, "nvme_namespace_write_protected", "device", "/dev/nvme0n1"); !ok || got != test.want {
+			t.Errorf("%s: nvme_namespace_write_protected = %v, %v, want %v", test.name, got, ok, test.want)
+		}
+	}
+	// drives without namespace write protection skip the metric
+	families := gatherNamespaceMetrics(t, `{"nsze": 1953525168}`)
+	if _, ok := families["nvme_namespace_write_protected"]; ok {
+		t.Errorf("nvme_namespace_write_protected exported without get-feature 0x84 support")
+	}
+}
+
+func TestNamespaceIOBoundaries(t *testing.T) {
+	// nsfeat bit 4 makes the 0's based preferred write fields valid
+	families := gatherNamespaceMetrics(t, `{"nsze": 1953525168, "nsfeat": 16, "noiob": 256, "npwg": 7, "npwa": 7, "nows": 31}`)
+	tests := map[string]float64{
+		"nvme_namespace_optimal_io_boundary_blocks":         256,
+		"nvme_namespace_preferred_write_granularity_blocks": 8,
+		"nvme_namespace_preferred_write_alignment_blocks":   8,
+		"nvme_namespace_optimal_write_size_blocks":          32,
+	}
+	for name, want := range tests {
+		if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, ok, want)
+		}
+	}
+	// without optperf and noiob none are reported
+	families = gatherNamespaceMetrics(t, `{"nsze": 1953525168, "nsfeat": 0, "noiob": 0, "npwg": 7, "npwa": 7, "nows": 31}`)
+	for name := range tests {
+		if _, ok := families[name]; ok {
+			t.Errorf("%s exported without optperf or noiob", name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+// Run nvme-cli subcommands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nsenterTarget runs nvme in the mount and network namespaces of this pid,
+// e.g. 1 to run the host's nvme-cli from a container, when not empty
+var nsenterTarget string
+
+// useSudo runs nvme with "sudo -n" so the exporter can run unprivileged
+// with a sudoers entry for nvme
+var useSudo bool
+
+// commandTimeout kills nvme commands running longer, e.g. on a wedged
+// controller, so they don't hang the scrape. 0 disables the timeout.
+var commandTimeout = 10 * time.Second
+
+// commandTimeoutError is returned for commands killed by commandTimeout
+type commandTimeoutError struct {
+	command string
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.command, commandTimeout)
+}
+
+// commandRunner runs a command and returns its stdout. The collector runs
+// nvme through its runner, tests pass one serving canned nvme output.
+type commandRunner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// execRunner runs commands with os/exec, killed after commandTimeout
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if commandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, commandTimeout)
+		defer cancel()
+	}
+	output, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return output, &commandTimeoutError{command: strings.Join(append([]string{name}, args...), " ")}
+	}
+	return output, err
+}
+
+// nvmeCommandLine returns the command name and arguments running nvme with
+// args
+func nvmeCommandLine(args ...string) (string, []string) {
+	name := "nvme"
+	if nsenterTarget != "" {
+		name, args = "nsenter", append([]string{"-t", nsenterTarget, "-m", "-n", "--", "nvme"}, args...)
+	}
+	if useSudo {
+		name, args = "sudo", append([]string{"-n", name}, args...)
+	}
+	return name, args
+}
+
+// checkNvmeAccess runs nvme list to check that nvme can be run with the
+// exporter's privileges. With sudo -n it fails instead of prompting for a
+// password when the sudoers entry doesn't allow it.
+func checkNvmeAccess(runner commandRunner) error {
+	_, err := nvmeOutput(runner, "list", "-o", "json")
+	if exitErr, ok := err.(*exec.ExitError); ok && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+	return err
+}
+
+// nvmeOutput runs nvme with args once with runner and returns its stdout
+func nvmeOutput(runner commandRunner, args ...string) ([]byte, error) {
+	name, args := nvmeCommandLine(args...)
+	return runner.Run(name, args...)
+}
+
+// bannerRunner records whether nvme-cli printed anything before the json
+// output of the commands run through it, such as the deprecation banner of
+// some distribution wrappers, until the next reset
+type bannerRunner struct {
+	commandRunner
+	detected int32
+}
+
+// reset returns whether a banner was detected since the last reset, so the
+// collector reports banners seen during each collection
+func (r *bannerRunner) reset() bool {
+	return atomic.SwapInt32(&r.detected, 0) == 1
+}
+
+// bannerWarning logs the first banner stripped by the process
+var bannerWarning sync.Once
+
+// commandPolicy is the failure handling of an nvme subcommand
+type commandPolicy struct {
+	// Retries is the number of times a failed command is run again
+	Retries int `json:"retries"`
+	// SkipDevice skips all other metrics of the device when the command
+	// fails, instead of only the metrics of the command. Only smart-log and
+	// id-ctrl, which run first for each device, skip devices.
+	SkipDevice bool `json:"skip_device"`
+}
+
+// commandPolicies by subcommand, the first argument to nvme. Nothing is
+// retried unless the command policy file sets retries, and only a failed
+// smart-log skips its device, other commands only omit their own metrics.
+var commandPolicies = map[string]commandPolicy{
+	"smart-log": {SkipDevice: true},
+}
+
+func policyFor(subcommand string) commandPolicy {
+	return commandPolicies[subcommand]
+}
+
+// loadCommandPolicies reads a json object of policies by subcommand, e.g.
+// {"smart-log": {"retries": 2, "skip_device": true}}, replacing the default
+// policy of each subcommand in the file.
+func loadCommandPolicies(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var policies map[string]commandPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for subcommand, policy := range policies {
+		if policy.Retries < 0 {
+			return fmt.Errorf("policy of %s has negative retries", subcommand)
+		}
+		commandPolicies[subcommand] = policy
+	}
+	return nil
+}
+
+// runNvme runs nvme with args, retrying failures as configured by the
+// policy of the subcommand. Locked drives and timeouts aren't retried.
+func runNvme(runner commandRunner, args ...string) ([]byte, error) {
+	retries := policyFor(args[0]).Retries
+	for attempt := 0; ; attempt++ {
+		output, err := nvmeOutput(runner, args...)
+		if err == nil || attempt >= retries || isLockedError(err) {
+			return output, err
+		}
+		if _, ok := err.(*commandTimeoutError); ok {
+			return output, err
+		}
+		debugf("Retrying nvme %s after error: %s\n", args[0], err)
+	}
+}
+
+// runNvmeJSON runs nvme with args and returns its json output, stripped of
+// any banner or warnings printed around it. Each output is checked on its
+// own, a banner is recorded on runner when it is a bannerRunner.
+func runNvmeJSON(runner commandRunner, args ...string) ([]byte, error) {
+	output, err := runNvme(runner, args...)
+	if err != nil {
+		return output, err
+	}
+	trimmed := trimJSON(output)
+	leading := bytes.TrimSpace(bytes.TrimPrefix(output, []byte("\xef\xbb\xbf")))
+	if len(trimmed) > 0 && !bytes.HasPrefix(leading, trimmed) {
+		bannerWarning.Do(func() {
+			warnf("Stripped a banner printed before the json output of nvme %s\n", args[0])
+		})
+		if banners, ok := runner.(*bannerRunner); ok {
+			atomic.StoreInt32(&banners.detected, 1)
+		}
+	}
+	return trimmed, nil
+}
+
+// runNvmeBinary runs nvme with args and returns the last size bytes of its
+// raw binary output, anything printed before them is a banner
+func runNvmeBinary(runner commandRunner, size int, args ...string) ([]byte, error) {
+	output, err := runNvme(runner, args...)
+	if err != nil || len(output) <= size {
+		return output, err
+	}
+	bannerWarning.Do(func() {
+		warnf("Stripped a banner printed before the binary output of nvme %s\n", args[0])
+	})
+	if banners, ok := runner.(*bannerRunner); ok {
+		atomic.StoreInt32(&banners.detected, 1)
+	}
+	return output[len(output)-size:], nil
+}
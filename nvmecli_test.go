@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunNvmeJSONBanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+		banner bool
+	}{
+		{"plain", `{"temperature":310}`, `{"temperature":310}`, false},
+		{"trailing newline", "{\"temperature\":310}\n", `{"temperature":310}`, false},
+		{"byte order mark", "\xef\xbb\xbf{\"temperature\":310}", `{"temperature":310}`, false},
+		{"deprecation banner", "nvme: this command is deprecated, use nvme-smart\n{\"temperature\":310}\n", `{"temperature":310}`, true},
+		{"warning after json", "{\"temperature\":310}\nwarning: unknown field\n", `{"temperature":310}`, false},
+	}
+	for _, test := range tests {
+		runner := &bannerRunner{commandRunner: fakeRunner{"smart-log": test.output}}
+		got, err := runNvmeJSON(runner, "smart-log", "/dev/nvme0n1", "-o", "json")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: runNvmeJSON() = %q, want %q", test.name, got, test.want)
+		}
+		if banner := runner.reset(); banner != test.banner {
+			t.Errorf("%s: banner detected = %v, want %v", test.name, banner, test.banner)
+		}
+	}
+}
+
+func TestBannerDetectedPerCollection(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": "nvme: this command is deprecated, use nvme-smart\n" + testSmartLog,
+	}
+	collector := newNvmeCollector(testCollectorConfig(runner))
+	families := gatherMetrics(t, collector)
+	if got, _ := metricValue(families, "nvme_cli_banner_detected"); got != 1 {
+		t.Errorf("nvme_cli_banner_detected = %v with a banner, want 1", got)
+	}
+	if got, _ := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); got != 36.85 {
+		t.Errorf("nvme_temperature = %v after stripping the banner, want 36.85", got)
+	}
+	// an upgraded nvme-cli no longer prints the banner
+	runner["smart-log"] = testSmartLog
+	families = gatherMetrics(t, collector)
+	if got, _ := metricValue(families, "nvme_cli_banner_detected"); got != 0 {
+		t.Errorf("nvme_cli_banner_detected = %v without a banner, want 0", got)
+	}
+}
+
+// recordingRunner records the command lines it runs
+type recordingRunner struct {
+	commands []string
+}
+
+func (r *recordingRunner) Run(name string, args ...string) ([]byte, error) {
+	r.commands = append(r.commands, strings.Join(append([]string{name}, args...), " "))
+	return []byte("{}"), nil
+}
+
+func TestNvmeCommandLine(t *testing.T) {
+	oldNsenterTarget, oldUseSudo := nsenterTarget, useSudo
+	defer func() { nsenterTarget, useSudo = oldNsenterTarget, oldUseSudo }()
+	tests := []struct {
+		nsenterTarget string
+		useSudo       bool
+		want          string
+	}{
+		{"", false, "nvme smart-log /dev/nvme0n1 -o json"},
+		{"1", false, "nsenter -t 1 -m -n -- nvme smart-log /dev/nvme0n1 -o json"},
+		{"4242", false, "nsenter -t 4242 -m -n -- nvme smart-log /dev/nvme0n1 -o json"},
+		{"", true, "sudo -n nvme smart-log /dev/nvme0n1 -o json"},
+		{"1", true, "sudo -n nsenter -t 1 -m -n -- nvme smart-log /dev/nvme0n1 -o json"},
+	}
+	for _, test := range tests {
+		nsenterTarget, useSudo = test.nsenterTarget, test.useSudo
+		runner := &recordingRunner{}
+		if _, err := runNvmeJSON(runner, "smart-log", "/dev/nvme0n1", "-o", "json"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(runner.commands) != 1 || runner.commands[0] != test.want {
+			t.Errorf("nsenter-target %q, sudo %v: ran %q, want %q", test.nsenterTarget, test.useSudo, runner.commands, test.want)
+		}
+	}
+}
+
+// restoreCommandPolicies restores the default policies after a test
+// changes them
+func restoreCommandPolicies(t *testing.T) {
+	defaults := make(map[string]commandPolicy)
+	for subcommand, policy := range commandPolicies {
+		defaults[subcommand] = policy
+	}
+	t.Cleanup(func() { commandPolicies = defaults })
+}
+
+func TestLoadCommandPolicies(t *testing.T) {
+	restoreCommandPolicies(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policies.json")
+	if err := ioutil.WriteFile(path, []byte(`{"smart-log": {"retries": 2}, "self-test-log": {"retries": 1}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCommandPolicies(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := map[string]commandPolicy{
+		// policies in the file replace the default
+		"smart-log":     {Retries: 2},
+		"self-test-log": {Retries: 1},
+		// the others keep it
+		"id-ctrl": {},
+		"id-ns":   {},
+	}
+	for subcommand, want := range tests {
+		if got := policyFor(subcommand); got != want {
+			t.Errorf("policy of %s = %+v, want %+v", subcommand, got, want)
+		}
+	}
+	for _, file := range []string{`{"smart-log": {"retries": -1}}`, `{"smart-log": 1}`} {
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadCommandPolicies(path); err == nil {
+			t.Errorf("expected an error loading %s", file)
+		}
+	}
+}
+
+func TestRunNvmeRetries(t *testing.T) {
+	restoreCommandPolicies(t)
+	commandPolicies["self-test-log"] = commandPolicy{Retries: 2}
+	tests := []struct {
+		subcommand string
+		runs       int
+	}{
+		{"self-test-log", 3},
+		// nothing is retried by default
+		{"smart-log", 1},
+		{"id-ctrl", 1},
+		{"error-log", 1},
+	}
+	for _, test := range tests {
+		runner := &failingRunner{errors: map[string]error{test.subcommand: exitError(t, "NVMe status: Internal Error(0x6)")}}
+		if _, err := runNvme(runner, test.subcommand, "/dev/nvme0"); err == nil {
+			t.Errorf("%s: expected an error", test.subcommand)
+		}
+		if n := runner.runs[test.subcommand]; n != test.runs {
+			t.Errorf("%s ran %d times, want %d", test.subcommand, n, test.runs)
+		}
+	}
+	// a retry that succeeds returns its output
+	commandPolicies["smart-log"] = commandPolicy{Retries: 1, SkipDevice: true}
+	runner := &flakyRunner{failures: 1, output: testSmartLog}
+	output, err := runNvme(runner, "smart-log", "/dev/nvme0n1")
+	if err != nil || string(output) != testSmartLog {
+		t.Errorf("runNvme() = %q, %v after a failure, want the smart-log", output, err)
+	}
+}
+
+// flakyRunner fails its first failures commands and then serves output
+type flakyRunner struct {
+	failures int
+	output   string
+}
+
+func (r *flakyRunner) Run(name string, args ...string) ([]byte, error) {
+	if r.failures > 0 {
+		r.failures--
+		return nil, fmt.Errorf("nvme %s failed", args[0])
+	}
+	return []byte(r.output), nil
+}
+
+func TestCommandPolicySkipDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		subcommand string
+		policy     commandPolicy
+		deviceInfo bool
+		smartLog   bool
+	}{
+		{"smart-log skips the device", "smart-log", commandPolicy{SkipDevice: true}, false, false},
+		{"smart-log omits its metrics", "smart-log", commandPolicy{}, true, false},
+		{"id-ctrl skips the device", "id-ctrl", commandPolicy{SkipDevice: true}, false, false},
+		{"id-ctrl omits its metrics", "id-ctrl", commandPolicy{}, true, true},
+	}
+	for _, test := range tests {
+		restoreCommandPolicies(t)
+		commandPolicies[test.subcommand] = test.policy
+		useTestSysfs(t)
+		runner := &failingRunner{
+			fakeRunner: fakeRunner{
+				"list":      testNvmeList,
+				"id-ctrl":   testIdCtrl,
+				"smart-log": testSmartLog,
+			},
+			errors: map[string]error{test.subcommand: exitError(t, "NVMe status: Internal Error(0x6)")},
+		}
+		families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+		if _, ok := metricValue(families, "nvme_device_info", "device", "/dev/nvme0n1"); ok != test.deviceInfo {
+			t.Errorf("%s: nvme_device_info exported = %v, want %v", test.name, ok, test.deviceInfo)
+		}
+		if _, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); ok != test.smartLog {
+			t.Errorf("%s: nvme_temperature exported = %v, want %v", test.name, ok, test.smartLog)
+		}
+	}
+}
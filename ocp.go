@@ -0,0 +1,209 @@
+package main
+
+// Export metrics from the OCP (Open Compute Project) datacenter NVMe SSD
+// smart extended log page (0xC0), read with the nvme-cli ocp plugin, and
+// the telemetry log header. Drives that don't implement these log pages
+// are skipped.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type ocpCollector struct {
+	nvmeDeallocCommands         *prometheus.Desc
+	nvmeDeallocBytes            *prometheus.Desc
+	nvmePowerDraw               *prometheus.Desc
+	nvmeSpareRemaining          *prometheus.Desc
+	nvmeTelemetryDataAreaBlocks *prometheus.Desc
+	nvmeTelemetryGeneration     *prometheus.Desc
+	nvmeThrottleEvents          *prometheus.Desc
+	nvmeThrottleSeconds         *prometheus.Desc
+	nvmeManufactureDate         *prometheus.Desc
+	runner                      commandRunner
+
+	mu          sync.Mutex
+	unsupported map[string]bool
+}
+
+func newOcpCollector(runner commandRunner) *ocpCollector {
+	return &ocpCollector{
+		nvmeDeallocCommands: prometheus.NewDesc(
+			metricName("dealloc_commands_total"),
+			"Number of deallocate (TRIM) commands completed",
+			labels,
+			nil,
+		),
+		nvmeDeallocBytes: prometheus.NewDesc(
+			metricName("dealloc_bytes_total"),
+			"Number of bytes deallocated (TRIMmed) by the host",
+			labels,
+			nil,
+		),
+		nvmePowerDraw: prometheus.NewDesc(
+			metricName("power_draw_watts"),
+			"Power currently drawn by the drive in watts",
+			labels,
+			nil,
+		),
+		nvmeSpareRemaining: prometheus.NewDesc(
+			metricName("spare_remaining_ratio"),
+			"Ratio of available spare blocks to total spare blocks",
+			labels,
+			nil,
+		),
+		nvmeTelemetryDataAreaBlocks: prometheus.NewDesc(
+			metricName("ocp_telemetry_data_area_blocks"),
+			"Last 512 byte block of each controller-initiated telemetry data area",
+			[]string{"device", "area"},
+			nil,
+		),
+		nvmeTelemetryGeneration: prometheus.NewDesc(
+			metricName("ocp_telemetry_generation"),
+			"Generation number of the controller-initiated telemetry data, changes when the drive captures a new snapshot",
+			labels,
+			nil,
+		),
+		nvmeThrottleEvents: prometheus.NewDesc(
+			metricName("ocp_thermal_throttle_events_total"),
+			"Number of thermal throttling events reported by the OCP smart extended log",
+			labels,
+			nil,
+		),
+		nvmeThrottleSeconds: prometheus.NewDesc(
+			metricName("ocp_thermal_throttle_seconds_total"),
+			"Total time in seconds the drive has been thermally throttled, reported by the OCP smart extended log",
+			labels,
+			nil,
+		),
+		nvmeManufactureDate: prometheus.NewDesc(
+			metricName("manufacture_date_info"),
+			"Manufacturing date reported by the drive, always 1",
+			[]string{"device", "date"},
+			nil,
+		),
+		runner:      runner,
+		unsupported: make(map[string]bool),
+	}
+}
+
+func (c *ocpCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeDeallocCommands
+	ch <- c.nvmeDeallocBytes
+	ch <- c.nvmePowerDraw
+	ch <- c.nvmeSpareRemaining
+	ch <- c.nvmeTelemetryDataAreaBlocks
+	ch <- c.nvmeTelemetryGeneration
+	ch <- c.nvmeThrottleEvents
+	ch <- c.nvmeThrottleSeconds
+	ch <- c.nvmeManufactureDate
+}
+
+func (c *ocpCollector) collect(ch chan<- prometheus.Metric, nvmeDevice string) {
+	c.collectSmartLog(ch, nvmeDevice)
+	c.collectTelemetryHeader(ch, nvmeDevice)
+}
+
+func (c *ocpCollector) collectSmartLog(ch chan<- prometheus.Metric, nvmeDevice string) {
+	ocpSmartLog, err := runNvmeJSON(c.runner, "ocp", "smart-add-log", nvmeDevice, "-o", "json")
+	if err != nil {
+		c.logUnsupported("OCP metrics", nvmeDevice, err)
+		return
+	}
+	if !gjson.ValidBytes(ocpSmartLog) {
+		warnf("Skipping OCP metrics for device %s: ocp smart-add-log json is not valid\n", nvmeDevice)
+		return
+	}
+	ocpMetrics := gjson.ParseBytes(ocpSmartLog)
+	// deallocate, power and spare block statistics are vendor extensions
+	// of the log page and are only reported by some drives
+	if v := ocpMetrics.Get("Deallocate command count"); v.Exists() {
+		ch <- prometheus.MustNewConstMetric(c.nvmeDeallocCommands, prometheus.CounterValue, ocpValue(v), nvmeDevice)
+	}
+	if v := ocpMetrics.Get("Deallocated bytes"); v.Exists() {
+		ch <- prometheus.MustNewConstMetric(c.nvmeDeallocBytes, prometheus.CounterValue, ocpValue(v), nvmeDevice)
+	}
+	// power is reported in milliwatts
+	if v := ocpMetrics.Get("Power consumption (mW)"); v.Exists() {
+		ch <- prometheus.MustNewConstMetric(c.nvmePowerDraw, prometheus.GaugeValue, ocpValue(v)/1000, nvmeDevice)
+	}
+	// unlike the normalized avail_spare percentage the absolute block
+	// counts don't plateau at 100
+	availableSpare := ocpMetrics.Get("Available spare blocks")
+	totalSpare := ocpMetrics.Get("Total spare blocks")
+	if availableSpare.Exists() && ocpValue(totalSpare) > 0 {
+		ch <- prometheus.MustNewConstMetric(c.nvmeSpareRemaining, prometheus.GaugeValue, ocpValue(availableSpare)/ocpValue(totalSpare), nvmeDevice)
+	}
+	// the throttling event count is part of the log page, the total
+	// throttling time is a vendor extension
+	if v := ocpMetrics.Get("Number of Thermal throttling events"); v.Exists() {
+		ch <- prometheus.MustNewConstMetric(c.nvmeThrottleEvents, prometheus.CounterValue, ocpValue(v), nvmeDevice)
+	}
+	if v := ocpMetrics.Get("Thermal throttling time (s)"); v.Exists() {
+		ch <- prometheus.MustNewConstMetric(c.nvmeThrottleSeconds, prometheus.CounterValue, ocpValue(v), nvmeDevice)
+	}
+	// the manufacturing date is a vendor extension, reported as a string in
+	// the vendor's format
+	for _, key := range []string{"Manufacture date", "Manufacturing date"} {
+		if v := ocpMetrics.Get(key); v.String() != "" {
+			ch <- prometheus.MustNewConstMetric(c.nvmeManufactureDate, prometheus.GaugeValue, 1, nvmeDevice, strings.TrimSpace(v.String()))
+			break
+		}
+	}
+}
+
+// collectTelemetryHeader reads only the 512 byte header of the
+// controller-initiated telemetry log (0x08), not the telemetry data itself.
+func (c *ocpCollector) collectTelemetryHeader(ch chan<- prometheus.Metric, nvmeDevice string) {
+	header, err := runNvmeBinary(c.runner, 512, "get-log", nvmeDevice, "--log-id=0x08", "--log-len=512", "--raw-binary")
+	if err != nil {
+		c.logUnsupported("OCP telemetry metrics", nvmeDevice, err)
+		return
+	}
+	if len(header) < 512 {
+		c.logUnsupported("OCP telemetry metrics", nvmeDevice, fmt.Errorf("short telemetry log header of %d bytes", len(header)))
+		return
+	}
+	dataAreas := []float64{
+		float64(binary.LittleEndian.Uint16(header[8:10])),
+		float64(binary.LittleEndian.Uint16(header[10:12])),
+		float64(binary.LittleEndian.Uint16(header[12:14])),
+		float64(binary.LittleEndian.Uint32(header[16:20])),
+	}
+	for i, blocks := range dataAreas {
+		ch <- prometheus.MustNewConstMetric(c.nvmeTelemetryDataAreaBlocks, prometheus.GaugeValue, blocks, nvmeDevice, strconv.Itoa(i+1))
+	}
+	// byte 383 is the controller-initiated data generation number
+	ch <- prometheus.MustNewConstMetric(c.nvmeTelemetryGeneration, prometheus.GaugeValue, float64(header[383]), nvmeDevice)
+}
+
+// logUnsupported logs that a drive doesn't implement an OCP log page the
+// first time reading it fails, and only at debug level afterwards, so
+// non-OCP drives don't log on every scrape
+func (c *ocpCollector) logUnsupported(metrics string, nvmeDevice string, err error) {
+	c.mu.Lock()
+	logged := c.unsupported[metrics+" "+nvmeDevice]
+	c.unsupported[metrics+" "+nvmeDevice] = true
+	c.mu.Unlock()
+	if logged {
+		debugf("Skipping %s for device %s: %s\n", metrics, nvmeDevice, err)
+		return
+	}
+	warnf("Skipping %s for device %s: %s\n", metrics, nvmeDevice, err)
+}
+
+// ocpValue converts an OCP log field to a float. 128 bit fields are
+// reported by nvme-cli as an object with hi and lo 64 bit halves.
+func ocpValue(v gjson.Result) float64 {
+	if v.IsObject() {
+		return float64(v.Get("hi").Uint())*math.Pow(2, 64) + float64(v.Get("lo").Uint())
+	}
+	return v.Float()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tidwall/gjson"
+)
+
+// gatherOcpMetrics collects the test drive with the OCP collector enabled,
+// serving the nvme output in runner
+func gatherOcpMetrics(t *testing.T, runner fakeRunner) map[string]*dto.MetricFamily {
+	t.Helper()
+	useTestSysfs(t)
+	runner["list"] = testNvmeList
+	runner["id-ctrl"] = testIdCtrl
+	runner["smart-log"] = testSmartLog
+	config := testCollectorConfig(runner)
+	config.collectOCP = true
+	return gatherMetrics(t, newNvmeCollector(config))
+}
+
+// testOcpSmartAddLog is the output of nvme ocp smart-add-log -o json for a
+// drive implementing version 3 of the OCP smart extended log page, with the
+// keys and value formats of nvme-cli 2.x
+const testOcpSmartAddLog = `{
+  "Physical media units written": "59723018240",
+  "Physical media units read": "108262080512",
+  "Bad user nand blocks - Raw": 0,
+  "Bad user nand blocks - Normalized": 100,
+  "Bad system nand blocks - Raw": 0,
+  "Bad system nand blocks - Normalized": 100,
+  "XOR recovery count": 0,
+  "Uncorrectable read error count": 0,
+  "Soft ecc error count": 0,
+  "End to end detected errors": 0,
+  "End to end corrected errors": 0,
+  "System data percent used": 1,
+  "Refresh counts": 0,
+  "Max User data erase counts": 21,
+  "Min User data erase counts": 3,
+  "Number of Thermal throttling events": 3,
+  "Current throttling status": 0,
+  "PCIe correctable error count": 0,
+  "Incomplete shutdowns": 0,
+  "Percent free blocks": 24,
+  "Capacitor health": 100,
+  "Unaligned I/O": 0,
+  "Security Version Number": 0,
+  "NUSE - Namespace utilization": 1953506646,
+  "PLP start count": "37",
+  "Endurance estimate": "7008000000000000",
+  "Log page version": 3,
+  "Log page GUID": "0xafd514c97c6f4f9ca4f2bfea2810afc5"
+}`
+
+func TestOcpSmartAddLog(t *testing.T) {
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": testOcpSmartAddLog,
+	})
+	if got, ok := metricValue(families, "nvme_ocp_thermal_throttle_events_total", "device", "/dev/nvme0n1"); !ok || got != 3 {
+		t.Errorf("nvme_ocp_thermal_throttle_events_total = %v, %v, want 3", got, ok)
+	}
+	// the vendor extensions aren't part of the log page
+	for _, name := range []string{
+		"nvme_dealloc_commands_total",
+		"nvme_dealloc_bytes_total",
+		"nvme_power_draw_watts",
+		"nvme_spare_remaining_ratio",
+		"nvme_ocp_thermal_throttle_seconds_total",
+		"nvme_manufacture_date_info",
+	} {
+		if _, ok := families[name]; ok {
+			t.Errorf("%s exported without its vendor extension", name)
+		}
+	}
+}
+
+func TestOcpUnsupportedLoggedOnce(t *testing.T) {
+	useTestSysfs(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	// neither log page is in the runner, so reading them fails like on a
+	// drive without them
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})
+	config.collectOCP = true
+	collector := newNvmeCollector(config)
+	for i := 0; i < 3; i++ {
+		gatherMetrics(t, collector)
+	}
+	for _, message := range []string{
+		"Skipping OCP metrics for device /dev/nvme0n1",
+		"Skipping OCP telemetry metrics for device /dev/nvme0n1",
+	} {
+		if n := strings.Count(buf.String(), message); n != 1 {
+			t.Errorf("%q logged %d times in 3 scrapes, want once:\n%s", message, n, buf.String())
+		}
+	}
+}
+
+func TestOcpValue(t *testing.T) {
+	tests := []struct {
+		json string
+		want float64
+	}{
+		{`12345`, 12345},
+		{`{"hi": 0, "lo": 4096}`, 4096},
+		{`{"hi": 1, "lo": 0}`, 18446744073709551616},
+		// nvme-cli 2.x prints 128 bit fields as decimal strings
+		{`"59723018240"`, 59723018240},
+	}
+	for _, test := range tests {
+		if got := ocpValue(gjson.Parse(test.json)); got != test.want {
+			t.Errorf("ocpValue(%s) = %v, want %v", test.json, got, test.want)
+		}
+	}
+}
+
+func TestOcpDeallocateStatistics(t *testing.T) {
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Deallocate command count": 250, "Deallocated bytes": {"hi": 0, "lo": 1073741824}}`,
+	})
+	if got, _ := metricValue(families, "nvme_dealloc_commands_total", "device", "/dev/nvme0n1"); got != 250 {
+		t.Errorf("nvme_dealloc_commands_total = %v, want 250", got)
+	}
+	if got, _ := metricValue(families, "nvme_dealloc_bytes_total", "device", "/dev/nvme0n1"); got != 1073741824 {
+		t.Errorf("nvme_dealloc_bytes_total = %v, want 1073741824", got)
+	}
+	// drives without the vendor extension don't report deallocate statistics
+	families = gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Physical media units written": {"hi": 0, "lo": 1}}`,
+	})
+	if _, ok := families["nvme_dealloc_commands_total"]; ok {
+		t.Errorf("nvme_dealloc_commands_total exported without deallocate statistics")
+	}
+}
+
+func TestOcpPowerDraw(t *testing.T) {
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Power consumption (mW)": 8250, "Number of Thermal throttling events": 0}`,
+	})
+	if got, ok := metricValue(families, "nvme_power_draw_watts", "device", "/dev/nvme0n1"); !ok || got != 8.25 {
+		t.Errorf("nvme_power_draw_watts = %v, %v, want 8.25", got, ok)
+	}
+	families = gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Number of Thermal throttling events": 0}`,
+	})
+	if _, ok := families["nvme_power_draw_watts"]; ok {
+		t.Errorf("nvme_power_draw_watts exported for a drive without power fields")
+	}
+}
+
+func TestOcpSpareRemaining(t *testing.T) {
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Available spare blocks": {"hi": 0, "lo": 1500}, "Total spare blocks": {"hi": 0, "lo": 2000}}`,
+	})
+	if got, ok := metricValue(families, "nvme_spare_remaining_ratio", "device", "/dev/nvme0n1"); !ok || got != 0.75 {
+		t.Errorf("nvme_spare_remaining_ratio = %v, %v, want 0.75", got, ok)
+	}
+	// without a total there's no ratio
+	families = gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Available spare blocks": 1500, "Total spare blocks": 0}`,
+	})
+	if _, ok := families["nvme_spare_remaining_ratio"]; ok {
+		t.Errorf("nvme_spare_remaining_ratio exported without total spare blocks")
+	}
+}
+
+func TestOcpThermalThrottling(t *testing.T) {
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Number of Thermal throttling events": 12, "Thermal throttling time (s)": {"hi": 0, "lo": 3600}}`,
+	})
+	tests := map[string]float64{
+		"nvme_ocp_thermal_throttle_events_total":  12,
+		"nvme_ocp_thermal_throttle_seconds_total": 3600,
+	}
+	for name, want := range tests {
+		if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, ok, want)
+		}
+		if typ := families[name].GetType(); typ != dto.MetricType_COUNTER {
+			t.Errorf("%s is a %s, want a counter", name, typ)
+		}
+	}
+	// drives without the OCP log page still report the smart-log
+	families = gatherOcpMetrics(t, fakeRunner{})
+	if _, ok := families["nvme_ocp_thermal_throttle_events_total"]; ok {
+		t.Errorf("nvme_ocp_thermal_throttle_events_total exported without the OCP log page")
+	}
+	if got, _ := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); got != 36.85 {
+		t.Errorf("nvme_temperature = %v without the OCP log page, want 36.85", got)
+	}
+}
+
+func TestOcpManufactureDate(t *testing.T) {
+	for _, key := range []string{"Manufacture date", "Manufacturing date"} {
+		families := gatherOcpMetrics(t, fakeRunner{
+			"ocp smart-add-log": `{"` + key + `": " 2023-04-17 ", "Number of Thermal throttling events": 0}`,
+		})
+		if got, ok := metricValue(families, "nvme_manufacture_date_info", "device", "/dev/nvme0n1", "date", "2023-04-17"); !ok || got != 1 {
+			t.Errorf("%s: nvme_manufacture_date_info{date=\"2023-04-17\"} = %v, %v, want 1", key, got, ok)
+		}
+	}
+	// drives that don't report the date skip the metric
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{"Manufacture date": "", "Number of Thermal throttling events": 0}`,
+	})
+	if _, ok := families["nvme_manufacture_date_info"]; ok {
+		t.Errorf("nvme_manufacture_date_info exported without a date")
+	}
+}
+
+func TestOcpTelemetryHeader(t *testing.T) {
+	header := make([]byte, 512)
+	binary.LittleEndian.PutUint16(header[8:10], 100)
+	binary.LittleEndian.PutUint16(header[10:12], 2000)
+	binary.LittleEndian.PutUint16(header[12:14], 30000)
+	binary.LittleEndian.PutUint32(header[16:20], 400000)
+	header[383] = 7
+	families := gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{}`,
+		"get-log /dev/nvme0n1 --log-id=0x08 --log-len=512 --raw-binary": string(header),
+	})
+	for area, want := range map[string]float64{"1": 100, "2": 2000, "3": 30000, "4": 400000} {
+		if got, ok := metricValue(families, "nvme_ocp_telemetry_data_area_blocks", "device", "/dev/nvme0n1", "area", area); !ok || got != want {
+			t.Errorf("nvme_ocp_telemetry_data_area_blocks{area=%q} = %v, %v, want %v", area, got, ok, want)
+		}
+	}
+	if got, ok := metricValue(families, "nvme_ocp_telemetry_generation", "device", "/dev/nvme0n1"); !ok || got != 7 {
+		t.Errorf("nvme_ocp_telemetry_generation = %v, %v, want 7", got, ok)
+	}
+	// a banner printed before the header is stripped
+	families = gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{}`,
+		"get-log":           "WARNING: deprecated\n" + string(header),
+	})
+	if got, ok := metricValue(families, "nvme_ocp_telemetry_generation", "device", "/dev/nvme0n1"); !ok || got != 7 {
+		t.Errorf("nvme_ocp_telemetry_generation = %v, %v after a banner, want 7", got, ok)
+	}
+	// a short header is skipped
+	families = gatherOcpMetrics(t, fakeRunner{
+		"ocp smart-add-log": `{}`,
+		"get-log":           string(header[:100]),
+	})
+	if _, ok := families["nvme_ocp_telemetry_generation"]; ok {
+		t.Errorf("nvme_ocp_telemetry_generation exported from a short header")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+// Export metrics from the persistent event log
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// persistent event log event types, see the Persistent Event Log section of
+// the NVMe base specification
+const (
+	pelEventSmartHealthSnapshot = 0x01
+	pelEventPowerOnOrReset      = 0x04
+	pelEventThermalExcursion    = 0x0d
+)
+
+// pelEventTypes are the event types counted by nvme_async_events_total and
+// nvme_persistent_events_in_log: controller resets, which show fabric
+// instability, and thermal excursions
+var pelEventTypes = map[uint64]string{
+	pelEventPowerOnOrReset:   "power_on_or_reset",
+	pelEventThermalExcursion: "thermal_excursion",
+}
+
+type persistentEventLogCollector struct {
+	nvmeSpareThresholdEvents *prometheus.Desc
+	nvmeAsyncEvents          *prometheus.Desc
+	nvmePersistentEvents     *prometheus.Desc
+	runner                   commandRunner
+
+	// the log only holds the most recent events, the counters add up the
+	// events logged after the newest one of the previous scrape
+	mu                   sync.Mutex
+	lastTimestamp        map[string]uint64
+	asyncEvents          map[string]map[string]float64
+	spareThresholdEvents map[string]float64
+}
+
+func newPersistentEventLogCollector(runner commandRunner) *persistentEventLogCollector {
+	return &persistentEventLogCollector{
+		nvmeSpareThresholdEvents: prometheus.NewDesc(
+			metricName("spare_threshold_events_total"),
+			"Number of smart/health snapshot events recorded in the persistent event log with available spare below threshold (critical_warning bit 0) since the exporter started",
+			labels,
+			nil,
+		),
+		nvmeAsyncEvents: prometheus.NewDesc(
+			metricName("async_events_total"),
+			"Number of controller reset (power_on_or_reset) and thermal excursion events recorded in the persistent event log since the exporter started",
+			[]string{"device", "type"},
+			nil,
+		),
+		nvmePersistentEvents: prometheus.NewDesc(
+			metricName("persistent_events_in_log"),
+			"Number of controller reset (power_on_or_reset) and thermal excursion events currently in the persistent event log, drops when the log wraps",
+			[]string{"device", "type"},
+			nil,
+		),
+		runner:               runner,
+		lastTimestamp:        make(map[string]uint64),
+		asyncEvents:          make(map[string]map[string]float64),
+		spareThresholdEvents: make(map[string]float64),
+	}
+}
+
+func (c *persistentEventLogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeSpareThresholdEvents
+	ch <- c.nvmeAsyncEvents
+	ch <- c.nvmePersistentEvents
+}
+
+func (c *persistentEventLogCollector) collect(ch chan<- prometheus.Metric, nvmeDevice string) {
+	// action 1 establishes a reporting context so the log is read as a
+	// consistent snapshot, it is released again once read
+	pel, err := runNvmeJSON(c.runner, "persistent-event-log", nvmeDevice, "--action=1", "-o", "json")
+	if err != nil {
+		warnf("Skipping persistent event log metrics for device %s: %s\n", nvmeDevice, err)
+		return
+	}
+	if _, err := nvmeOutput(c.runner, "persistent-event-log", nvmeDevice, "--action=2"); err != nil {
+		debugf("Error releasing persistent event log context for device %s: %s\n", nvmeDevice, err)
+	}
+	if !gjson.ValidBytes(pel) {
+		warnf("Skipping persistent event log metrics for device %s: persistent-event-log json is not valid\n", nvmeDevice)
+		return
+	}
+	events := make(map[uint64]float64)
+	logged := pelEvents(gjson.ParseBytes(pel))
+	for _, event := range logged {
+		events[event.Get("event_type").Uint()]++
+	}
+	// each type is exported, 0 when the log has no such events
+	for eventType, name := range pelEventTypes {
+		ch <- prometheus.MustNewConstMetric(c.nvmePersistentEvents, prometheus.GaugeValue, events[eventType], nvmeDevice, name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	asyncEvents, ok := c.asyncEvents[nvmeDevice]
+	if !ok {
+		asyncEvents = make(map[string]float64)
+		c.asyncEvents[nvmeDevice] = asyncEvents
+	}
+	for _, event := range c.newEvents(nvmeDevice, logged) {
+		eventType := event.Get("event_type").Uint()
+		if name, ok := pelEventTypes[eventType]; ok {
+			asyncEvents[name]++
+		}
+		if eventType == pelEventSmartHealthSnapshot {
+			criticalWarning := parseCriticalWarning(findKey(event, "critical_warning"))
+			c.spareThresholdEvents[nvmeDevice] += criticalWarningBit(criticalWarning, 0)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.nvmeSpareThresholdEvents, prometheus.CounterValue, c.spareThresholdEvents[nvmeDevice], nvmeDevice)
+	for _, name := range pelEventTypes {
+		ch <- prometheus.MustNewConstMetric(c.nvmeAsyncEvents, prometheus.CounterValue, asyncEvents[name], nvmeDevice, name)
+	}
+}
+
+// newEvents returns the events logged after the newest event seen in the
+// previous scrape of a device, all of them the first time. Events are told
+// apart by their timestamp. c.mu must be held.
+func (c *persistentEventLogCollector) newEvents(nvmeDevice string, events []gjson.Result) []gjson.Result {
+	last, seen := c.lastTimestamp[nvmeDevice]
+	newest := last
+	var newEvents []gjson.Result
+	for _, event := range events {
+		timestamp := pelTimestamp(event)
+		if !seen || timestamp > last {
+			newEvents = append(newEvents, event)
+		}
+		if timestamp > newest {
+			newest = timestamp
+		}
+	}
+	c.lastTimestamp[nvmeDevice] = newest
+	return newEvents
+}
+
+// pelTimestamp returns the timestamp of an event, nvme-cli releases name it
+// event_timestamp or timestamp
+func pelTimestamp(event gjson.Result) uint64 {
+	if timestamp := event.Get("event_timestamp"); timestamp.Exists() {
+		return timestamp.Uint()
+	}
+	return event.Get("timestamp").Uint()
+}
+
+// pelEvents returns every object with an event_type. nvme-cli releases
+// differ in how the events are nested below the log header.
+func pelEvents(result gjson.Result) []gjson.Result {
+	var events []gjson.Result
+	if result.IsObject() && result.Get("event_type").Exists() {
+		return append(events, result)
+	}
+	result.ForEach(func(_, value gjson.Result) bool {
+		if value.IsObject() || value.IsArray() {
+			events = append(events, pelEvents(value)...)
+		}
+		return true
+	})
+	return events
+}
+
+// findKey returns the first value of key at any depth below result
+func findKey(result gjson.Result, key string) gjson.Result {
+	if value := result.Get(key); value.Exists() {
+		return value
+	}
+	var found gjson.Result
+	result.ForEach(func(_, value gjson.Result) bool {
+		if value.IsObject() || value.IsArray() {
+			found = findKey(value, key)
+		}
+		return !found.Exists()
+	})
+	return found
+}
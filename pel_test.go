@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testPersistentEventLog has two smart/health snapshots with available spare
+// below threshold, one of them with another critical warning, one without,
+// two controller resets and a thermal excursion
+const testPersistentEventLog = `{
+  "log_id": 13,
+  "tnev": 6,
+  "events": [
+    {"event_type": 1, "timestamp": 1000, "smart_health_snapshot": {"critical_warning": 1, "avail_spare": 5, "spare_thresh": 10}},
+    {"event_type": 4, "timestamp": 1100, "power_on_reset": {"fw_rev": "1.0", "ctrl_id": 0}},
+    {"event_type": 1, "timestamp": 1200, "smart_health_snapshot": {"critical_warning": 0, "avail_spare": 100, "spare_thresh": 10}},
+    {"event_type": 13, "timestamp": 1300, "thermal_excursion": {"over_temp": 2, "threshold": 1}},
+    {"event_type": 4, "timestamp": 1400, "power_on_reset": {"fw_rev": "1.0", "ctrl_id": 0}},
+    {"event_type": 1, "timestamp": 1500, "smart_health_snapshot": {"critical_warning": "0x05", "avail_spare": 4, "spare_thresh": 10}}
+  ]
+}`
+
+func TestPersistentEventLogSpareThresholdEvents(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":                 testNvmeList,
+		"id-ctrl":              testIdCtrl,
+		"smart-log":            testSmartLog,
+		"persistent-event-log": testPersistentEventLog,
+	})
+	config.collectPersistentEventLog = true
+	collector := newNvmeCollector(config)
+	for i, want := range []float64{2, 2} {
+		families := gatherMetrics(t, collector)
+		got, ok := metricValue(families, "nvme_spare_threshold_events_total", "device", "/dev/nvme0n1")
+		if !ok {
+			t.Fatalf("nvme_spare_threshold_events_total is missing")
+		}
+		// the second scrape reads the same log, its events are counted once
+		if got != want {
+			t.Errorf("scrape %d: nvme_spare_threshold_events_total = %v, want %v", i, got, want)
+		}
+		if typ := families["nvme_spare_threshold_events_total"].GetType(); typ != dto.MetricType_COUNTER {
+			t.Errorf("nvme_spare_threshold_events_total is a %s, want a counter", typ)
+		}
+	}
+}
+
+func TestPersistentEventLogResetsAndThermalEvents(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":                 testNvmeList,
+		"id-ctrl":              testIdCtrl,
+		"smart-log":            testSmartLog,
+		"persistent-event-log": testPersistentEventLog,
+	})
+	config.collectPersistentEventLog = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	tests := map[string]float64{
+		"power_on_or_reset": 2,
+		"thermal_excursion": 1,
+	}
+	for eventType, want := range tests {
+		got, ok := metricValue(families, "nvme_persistent_events_in_log", "device", "/dev/nvme0n1", "type", eventType)
+		if !ok {
+			t.Errorf("nvme_persistent_events_in_log{type=%q} is missing", eventType)
+			continue
+		}
+		if got != want {
+			t.Errorf("nvme_persistent_events_in_log{type=%q} = %v, want %v", eventType, got, want)
+		}
+	}
+	// smart/health snapshots aren't counted by type
+	if n := len(families["nvme_persistent_events_in_log"].GetMetric()); n != len(tests) {
+		t.Errorf("nvme_persistent_events_in_log has %d series, want %d", n, len(tests))
+	}
+	if typ := families["nvme_persistent_events_in_log"].GetType(); typ != dto.MetricType_GAUGE {
+		t.Errorf("nvme_persistent_events_in_log is a %s, want a gauge", typ)
+	}
+}
+
+func TestPersistentEventLogAsyncEventsTotal(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":                 testNvmeList,
+		"id-ctrl":              testIdCtrl,
+		"smart-log":            testSmartLog,
+		"persistent-event-log": testPersistentEventLog,
+	}
+	config := testCollectorConfig(runner)
+	config.collectPersistentEventLog = true
+	collector := newNvmeCollector(config)
+	scrapes := []struct {
+		log  string
+		want map[string]float64
+	}{
+		{testPersistentEventLog, map[string]float64{"power_on_or_reset": 2, "thermal_excursion": 1}},
+		// events already counted aren't counted again
+		{testPersistentEventLog, map[string]float64{"power_on_or_reset": 2, "thermal_excursion": 1}},
+		// the log wrapped, dropping the first reset, and a reset was logged
+		{`{"events": [
+		  {"event_type": 13, "timestamp": 1300, "thermal_excursion": {"over_temp": 2, "threshold": 1}},
+		  {"event_type": 4, "timestamp": 1400, "power_on_reset": {"fw_rev": "1.0", "ctrl_id": 0}},
+		  {"event_type": 4, "event_timestamp": 1600, "power_on_reset": {"fw_rev": "1.0", "ctrl_id": 0}}
+		]}`, map[string]float64{"power_on_or_reset": 3, "thermal_excursion": 1}},
+	}
+	for i, scrape := range scrapes {
+		runner["persistent-event-log"] = scrape.log
+		families := gatherMetrics(t, collector)
+		for eventType, want := range scrape.want {
+			got, ok := metricValue(families, "nvme_async_events_total", "device", "/dev/nvme0n1", "type", eventType)
+			if !ok || got != want {
+				t.Errorf("scrape %d: nvme_async_events_total{type=%q} = %v, %v, want %v", i, eventType, got, ok, want)
+			}
+		}
+		if typ := families["nvme_async_events_total"].GetType(); typ != dto.MetricType_COUNTER {
+			t.Errorf("nvme_async_events_total is a %s, want a counter", typ)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+// Periodically push metrics to a Prometheus Pushgateway
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const userAgent = "nvme_exporter"
+
+// userAgentClient sets a descriptive User-Agent on outbound pushes
+type userAgentClient struct {
+	client *http.Client
+}
+
+func (c userAgentClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", userAgent)
+	return c.client.Do(req)
+}
+
+// pushMetrics pushes everything gathered to the gateway every interval,
+// grouped by job and instance so pushes from multiple hosts don't overwrite
+// each other.
+func pushMetrics(gatherer prometheus.Gatherer, gateway string, job string, instance string, interval time.Duration) {
+	pusher := newPusher(gatherer, gateway, job, instance, interval)
+	for ; ; time.Sleep(interval) {
+		if err := pusher.Push(); err != nil {
+			warnf("Error pushing metrics to %s: %s\n", gateway, err)
+			continue
+		}
+		debugf("Pushed metrics to %s\n", gateway)
+	}
+}
+
+// newPusher pushes to the job and instance group with the User-Agent set
+func newPusher(gatherer prometheus.Gatherer, gateway string, job string, instance string, timeout time.Duration) *push.Pusher {
+	return push.New(gateway, job).
+		Gatherer(gatherer).
+		Grouping("instance", instance).
+		Client(userAgentClient{client: &http.Client{Timeout: timeout}})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPushGrouping(t *testing.T) {
+	var path, agent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, agent = r.URL.Path, r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "nvme_up", Help: "Test"}))
+	if err := newPusher(registry, server.URL, "nvme_exporter", "host-a", time.Second).Push(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "/metrics/job/nvme_exporter/instance/host-a"; path != want {
+		t.Errorf("pushed to %s, want %s", path, want)
+	}
+	if agent != userAgent {
+		t.Errorf("User-Agent = %q, want %q", agent, userAgent)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// Report readiness on /healthz once nvme has listed a device
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// devicesDiscovered is set by the first nvme list that found a device,
+// which shows nvme is executable and has something to collect
+var devicesDiscovered int32
+
+func markDevicesDiscovered() {
+	if atomic.SwapInt32(&devicesDiscovered, 1) == 0 {
+		infof("Discovered nvme devices, ready\n")
+	}
+}
+
+// discoverDevices runs nvme list at startup so the exporter becomes ready
+// without waiting for the first scrape, parsing the given layout
+func discoverDevices(runner commandRunner, layout string) {
+	nvmeDeviceCmd, err := runNvmeJSON(runner, "list", "-v", "-o", "json")
+	if err != nil {
+		warnf("Error running nvme list at startup: %s\n", err)
+		return
+	}
+	namespaces, _, err := getDeviceList(nvmeDeviceCmd, layout)
+	if err != nil {
+		warnf("Error parsing nvme list at startup: %s\n", err)
+		return
+	}
+	if len(namespaces) > 0 {
+		markDevicesDiscovered()
+	}
+}
+
+// healthzHandler returns 200 once devices were discovered and 503 before
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&devicesDiscovered) == 0 {
+		http.Error(w, "No nvme devices discovered yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
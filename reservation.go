@@ -0,0 +1,65 @@
+package main
+
+// Export NVMe reservation state from nvme resv-report, for clustered and
+// shared-disk setups. Drives without reservation support are skipped.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type reservationCollector struct {
+	nvmeReservationHolder *prometheus.Desc
+	nvmeReservationType   *prometheus.Desc
+	runner                commandRunner
+}
+
+func newReservationCollector(runner commandRunner) *reservationCollector {
+	return &reservationCollector{
+		nvmeReservationHolder: prometheus.NewDesc(
+			metricName("reservation_holder"),
+			"Controller ID (cntlid) of the registrant holding the reservation",
+			labels,
+			nil,
+		),
+		nvmeReservationType: prometheus.NewDesc(
+			metricName("reservation_type"),
+			"Reservation type, 0 when the namespace is not reserved",
+			labels,
+			nil,
+		),
+		runner: runner,
+	}
+}
+
+func (c *reservationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeReservationHolder
+	ch <- c.nvmeReservationType
+}
+
+func (c *reservationCollector) collect(ch chan<- prometheus.Metric, nvmeDevice string) {
+	nvmeResvReport, err := runNvmeJSON(c.runner, "resv-report", nvmeDevice, "-o", "json")
+	if err != nil {
+		warnf("Skipping reservation metrics for device %s: %s\n", nvmeDevice, err)
+		return
+	}
+	if !gjson.ValidBytes(nvmeResvReport) {
+		warnf("Skipping reservation metrics for device %s: resv-report json is not valid\n", nvmeDevice)
+		return
+	}
+	resvReport := gjson.ParseBytes(nvmeResvReport)
+	ch <- prometheus.MustNewConstMetric(c.nvmeReservationType, prometheus.GaugeValue, resvReport.Get("rtype").Float(), nvmeDevice)
+	// registrants are reported under regctlext with extended data
+	// structures and under regctls otherwise
+	registrants := resvReport.Get("regctlext")
+	if !registrants.Exists() {
+		registrants = resvReport.Get("regctls")
+	}
+	for _, registrant := range registrants.Array() {
+		// bit 0 of rcsts is set for the registrant holding the reservation
+		if registrant.Get("rcsts").Uint()&1 == 1 {
+			ch <- prometheus.MustNewConstMetric(c.nvmeReservationHolder, prometheus.GaugeValue, registrant.Get("cntlid").Float(), nvmeDevice)
+			break
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestReservationReport(t *testing.T) {
+	tests := []struct {
+		name       string
+		report     string
+		rtype      float64
+		holder     float64
+		wantHolder bool
+	}{
+		{"extended", `{"gen": 3, "rtype": 5, "regctl": 2, "regctlext": [
+  {"cntlid": 1, "rcsts": 0, "rkey": 4660},
+  {"cntlid": 2, "rcsts": 1, "rkey": 22136}
+]}`, 5, 2, true},
+		{"not extended", `{"gen": 1, "rtype": 1, "regctl": 1, "regctls": [{"cntlid": 7, "rcsts": 1, "rkey": 1}]}`, 1, 7, true},
+		{"not reserved", `{"gen": 0, "rtype": 0, "regctl": 1, "regctls": [{"cntlid": 7, "rcsts": 0, "rkey": 1}]}`, 0, 0, false},
+	}
+	for _, test := range tests {
+		useTestSysfs(t)
+		config := testCollectorConfig(fakeRunner{
+			"list":        testNvmeList,
+			"id-ctrl":     testIdCtrl,
+			"smart-log":   testSmartLog,
+			"resv-report": test.report,
+		})
+		config.collectReservations = true
+		families := gatherMetrics(t, newNvmeCollector(config))
+		if got, ok := metricValue(families, "nvme_reservation_type", "device", "/dev/nvme0n1"); !ok || got != test.rtype {
+			t.Errorf("%s: nvme_reservation_type = %v, %v, want %v", test.name, got, ok, test.rtype)
+		}
+		got, ok := metricValue(families, "nvme_reservation_holder", "device", "/dev/nvme0n1")
+		if ok != test.wantHolder || got != test.holder {
+			t.Errorf("%s: nvme_reservation_holder = %v, %v, want %v, %v", test.name, got, ok, test.holder, test.wantHolder)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+// Detect smart-log counters that decrease between scrapes, e.g. when a
+// drive is replaced in place or its counters are reset
+
+import (
+	"sync"
+)
+
+type counterResetTracker struct {
+	mu       sync.Mutex
+	previous map[string][]float64
+	resets   map[string]float64
+}
+
+func newCounterResetTracker() *counterResetTracker {
+	return &counterResetTracker{
+		previous: make(map[string][]float64),
+		resets:   make(map[string]float64),
+	}
+}
+
+// observe records the counter values of a device and returns the number of
+// resets seen so far. A scrape where any counter decreased counts as one
+// reset.
+func (t *counterResetTracker) observe(nvmeDevice string, counters []float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	previous, ok := t.previous[nvmeDevice]
+	if ok && len(previous) == len(counters) {
+		for i := range counters {
+			if counters[i] < previous[i] {
+				t.resets[nvmeDevice]++
+				break
+			}
+		}
+	}
+	t.previous[nvmeDevice] = counters
+	return t.resets[nvmeDevice]
+}
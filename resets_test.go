@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestCounterResetTracker(t *testing.T) {
+	tracker := newCounterResetTracker()
+	tests := []struct {
+		device   string
+		counters []float64
+		want     float64
+	}{
+		{"/dev/nvme0n1", []float64{100, 50}, 0},
+		{"/dev/nvme0n1", []float64{120, 50}, 0},
+		// any decreasing counter is one reset
+		{"/dev/nvme0n1", []float64{10, 5}, 1},
+		{"/dev/nvme1n1", []float64{1, 1}, 0},
+		{"/dev/nvme0n1", []float64{11, 6}, 1},
+		{"/dev/nvme0n1", []float64{11, 0}, 2},
+	}
+	for i, test := range tests {
+		if got := tracker.observe(test.device, test.counters); got != test.want {
+			t.Errorf("scrape %d: observe(%s, %v) = %v, want %v", i, test.device, test.counters, got, test.want)
+		}
+	}
+}
+
+func TestCounterResetsBetweenScrapes(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"power_cycles": 20, "power_on_hours": 5000, "unsafe_shutdowns": 3}`,
+	}
+	config := testCollectorConfig(runner)
+	config.trackCounterResets = true
+	collector := newNvmeCollector(config)
+	families := gatherMetrics(t, collector)
+	if got, ok := metricValue(families, "nvme_counter_resets_total", "device", "/dev/nvme0n1"); !ok || got != 0 {
+		t.Errorf("nvme_counter_resets_total = %v, %v after the first scrape, want 0", got, ok)
+	}
+	// the drive was replaced in place
+	runner["smart-log"] = `{"power_cycles": 1, "power_on_hours": 2, "unsafe_shutdowns": 0}`
+	families = gatherMetrics(t, collector)
+	if got, _ := metricValue(families, "nvme_counter_resets_total", "device", "/dev/nvme0n1"); got != 1 {
+		t.Errorf("nvme_counter_resets_total = %v after the counters decreased, want 1", got)
+	}
+	if got, _ := metricValue(families, "nvme_power_on_hours", "device", "/dev/nvme0n1"); got != 2 {
+		t.Errorf("nvme_power_on_hours = %v, want the reset value 2", got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+// Export the number of controllers attached to each namespace, for
+// multi-controller and shared-namespace setups
+
+import (
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type namespaceControllersCollector struct {
+	nvmeNamespaceControllerCount *prometheus.Desc
+	runner                       commandRunner
+}
+
+func newNamespaceControllersCollector(runner commandRunner) *namespaceControllersCollector {
+	return &namespaceControllersCollector{
+		nvmeNamespaceControllerCount: prometheus.NewDesc(
+			metricName("namespace_controller_count"),
+			"Number of controllers the namespace is attached to",
+			labels,
+			nil,
+		),
+		runner: runner,
+	}
+}
+
+func (c *namespaceControllersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nvmeNamespaceControllerCount
+}
+
+func (c *namespaceControllersCollector) collect(ch chan<- prometheus.Metric, namespace nvmeNamespace) {
+	nsid := namespaceID(namespace.DevicePath)
+	if nsid == "" {
+		debugf("Skipping controller count for device %s: unknown namespace id\n", namespace.DevicePath)
+		return
+	}
+	nvmeListCtrl, err := runNvmeJSON(c.runner, "list-ctrl", "/dev/"+namespace.Controller, "-n", nsid, "-o", "json")
+	if err != nil {
+		warnf("Skipping controller count for device %s: %s\n", namespace.DevicePath, err)
+		return
+	}
+	if !gjson.ValidBytes(nvmeListCtrl) {
+		warnf("Skipping controller count for device %s: list-ctrl json is not valid\n", namespace.DevicePath)
+		return
+	}
+	count := gjson.GetBytes(nvmeListCtrl, "ctrl_list.#").Float()
+	ch <- prometheus.MustNewConstMetric(c.nvmeNamespaceControllerCount, prometheus.GaugeValue, count, namespace.DevicePath)
+}
+
+// namespaceID returns the namespace id of a namespace block device,
+// e.g. /dev/nvme0n1 -> 1
+func namespaceID(devicePath string) string {
+	if m := namespaceRegexp.FindStringSubmatch(filepath.Base(devicePath)); m != nil {
+		return m[2]
+	}
+	if m := genericRegexp.FindStringSubmatch(filepath.Base(devicePath)); m != nil {
+		return m[2]
+	}
+	return ""
+}
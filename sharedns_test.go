@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestNamespaceID(t *testing.T) {
+	tests := map[string]string{
+		"/dev/nvme0n1":   "1",
+		"/dev/nvme12n34": "34",
+		"/dev/ng1n2":     "2",
+		"/dev/nvme0":     "",
+		"/dev/nvme0c1n1": "",
+		"/dev/nvme0n1p1": "",
+	}
+	for device, want := range tests {
+		if got := namespaceID(device); got != want {
+			t.Errorf("namespaceID(%s) = %q, want %q", device, got, want)
+		}
+	}
+}
+
+func TestNamespaceControllerCount(t *testing.T) {
+	useTestSysfs(t)
+	config := testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+		// a namespace shared by two controllers of a dual-port drive
+		"list-ctrl /dev/nvme0 -n 1 -o json": `{"num_ctrl": 2, "ctrl_list": [{"ctrl_id": 1}, {"ctrl_id": 2}]}`,
+	})
+	config.collectNamespaceControllers = true
+	families := gatherMetrics(t, newNvmeCollector(config))
+	if got, ok := metricValue(families, "nvme_namespace_controller_count", "device", "/dev/nvme0n1"); !ok || got != 2 {
+		t.Errorf("nvme_namespace_controller_count = %v, %v, want 2", got, ok)
+	}
+}
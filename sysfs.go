@@ -0,0 +1,35 @@
+package main
+
+// Read block device statistics from sysfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var sysBlock = "/sys/block"
+
+// readInflight returns the number of read and write requests currently
+// in flight for a block device, from /sys/block/<dev>/inflight
+func readInflight(nvmeDevice string) (float64, error) {
+	inflight, err := ioutil.ReadFile(filepath.Join(sysBlock, filepath.Base(nvmeDevice), "inflight"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(inflight))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected inflight contents %q", string(inflight))
+	}
+	total := 0.0
+	for _, field := range fields {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += float64(value)
+	}
+	return total, nil
+}
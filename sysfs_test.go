@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadInflight(t *testing.T) {
+	useTestSysfs(t)
+	tests := []struct {
+		inflight string
+		want     float64
+		wantErr  bool
+	}{
+		{"       3        5\n", 8, false},
+		{"0 0\n", 0, false},
+		{"3\n", 0, true},
+		{"3 x\n", 0, true},
+	}
+	if err := os.MkdirAll(filepath.Join(sysBlock, "nvme0n1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(filepath.Join(sysBlock, "nvme0n1", "inflight"), []byte(test.inflight), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readInflight("/dev/nvme0n1")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("readInflight(%q): expected an error", test.inflight)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("readInflight(%q) = %v, %v, want %v", test.inflight, got, err, test.want)
+		}
+	}
+	if _, err := readInflight("/dev/nvme1n1"); err == nil {
+		t.Errorf("readInflight() of a missing device: expected an error")
+	}
+}
+
+func TestInflightCommandsOfPcieDevices(t *testing.T) {
+	useTestSysfs(t)
+	// useTestSysfs uses one directory for /sys/block and /sys/class/nvme
+	for path, contents := range map[string]string{
+		"nvme0n1/inflight": "2 1\n",
+		"nvme0/transport":  "pcie\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(sysBlock, path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sysBlock, path), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})))
+	if got, ok := metricValue(families, "nvme_inflight_commands", "device", "/dev/nvme0n1"); !ok || got != 3 {
+		t.Errorf("nvme_inflight_commands = %v, %v, want 3", got, ok)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Convert temperatures reported by nvme in kelvin to the configured scale
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	scaleCelsius    = "celsius"
+	scaleFahrenheit = "fahrenheit"
+	scaleKelvin     = "kelvin"
+)
+
+func validateTemperatureScale(scale string) error {
+	switch scale {
+	case scaleCelsius, scaleFahrenheit, scaleKelvin:
+		return nil
+	}
+	return fmt.Errorf("unknown temperature scale %q, must be one of celsius, fahrenheit or kelvin", scale)
+}
+
+// temperatureUnit describes the scale in metric help text
+func temperatureUnit(scale string) string {
+	if scale == scaleKelvin {
+		return "kelvin"
+	}
+	return "degrees " + scale
+}
+
+// convertTemperature converts from kelvin with the same 273.15 offset for
+// both celsius and fahrenheit, e.g. 300 K is 26.85 °C and 80.33 °F. Results
+// are rounded to hundredths so float error doesn't show up on dashboards.
+func convertTemperature(kelvin float64, scale string) float64 {
+	switch scale {
+	case scaleCelsius:
+		return roundHundredths(kelvin - 273.15)
+	case scaleKelvin:
+		return kelvin
+	}
+	return roundHundredths((kelvin-273.15)*9/5 + 32)
+}
+
+func roundHundredths(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// temperatureMetric is used for every metric read in kelvin, which are the
+// only values converted to the configured scale
+func (c *nvmeCollector) temperatureMetric(desc *prometheus.Desc, kelvin float64, label string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, convertTemperature(kelvin, c.temperatureScale), label)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertTemperature(t *testing.T) {
+	tests := []struct {
+		kelvin float64
+		scale  string
+		want   float64
+	}{
+		{300, scaleCelsius, 26.85},
+		{300, scaleFahrenheit, 80.33},
+		{300, scaleKelvin, 300},
+		{273.15, scaleCelsius, 0},
+		{273.15, scaleFahrenheit, 32},
+		// the sample output temperatures are rounded to hundredths
+		{313, scaleFahrenheit, 103.73},
+		{0, scaleCelsius, -273.15},
+	}
+	for _, test := range tests {
+		if got := convertTemperature(test.kelvin, test.scale); got != test.want {
+			t.Errorf("convertTemperature(%v, %s) = %v, want %v", test.kelvin, test.scale, got, test.want)
+		}
+	}
+}
+
+func TestTemperatureThresholdsShareScale(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"temperature": 300}`,
+	}
+	tests := []struct {
+		scale                          string
+		temperature, warning, critical float64
+	}{
+		// wctemp 343 K and cctemp 358 K
+		{scaleCelsius, 26.85, 69.85, 84.85},
+		{scaleFahrenheit, 80.33, 157.73, 184.73},
+		{scaleKelvin, 300, 343, 358},
+	}
+	for _, test := range tests {
+		config := testCollectorConfig(runner)
+		config.temperatureScale = test.scale
+		families := gatherMetrics(t, newNvmeCollector(config))
+		for name, want := range map[string]float64{
+			"nvme_temperature":                    test.temperature,
+			"nvme_warning_temperature_threshold":  test.warning,
+			"nvme_critical_temperature_threshold": test.critical,
+		} {
+			if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+				t.Errorf("%s: %s = %v, %v, want %v", test.scale, name, got, ok, want)
+			}
+			if help := families[name].GetHelp(); !strings.Contains(help, temperatureUnit(test.scale)) {
+				t.Errorf("%s: %s help %q doesn't name the unit %q", test.scale, name, help, temperatureUnit(test.scale))
+			}
+		}
+	}
+}
+
+func TestTemperatureSensorsBeyondEight(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":    testNvmeList,
+		"id-ctrl": testIdCtrl,
+		// sensor 3 isn't implemented
+		"smart-log": `{"temperature": 310, "temperature_sensor_1": 300, "temperature_sensor_3": 0, "temperature_sensor_9": 320, "temperature_sensor_10": 330}`,
+	}
+	config := testCollectorConfig(runner)
+	config.maxTempSensors = 10
+	families := gatherMetrics(t, newNvmeCollector(config))
+	for name, want := range map[string]float64{
+		"nvme_temperature_sensor1":  26.85,
+		"nvme_temperature_sensor9":  46.85,
+		"nvme_temperature_sensor10": 56.85,
+	} {
+		if got, ok := metricValue(families, name, "device", "/dev/nvme0n1"); !ok || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, ok, want)
+		}
+	}
+	if _, ok := families["nvme_temperature_sensor3"]; ok {
+		t.Errorf("nvme_temperature_sensor3 exported for an unimplemented sensor")
+	}
+	// the default of 8 sensors leaves out the rest
+	families = gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_temperature_sensor9"]; ok {
+		t.Errorf("nvme_temperature_sensor9 exported with max-temp-sensors 8")
+	}
+}
+
+func TestTemperatureWithoutReading(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"temperature": 0, "avail_spare": 100, "temperature_sensor_1": 0}`,
+	}
+	for _, scale := range []string{scaleCelsius, scaleKelvin} {
+		config := testCollectorConfig(runner)
+		config.temperatureScale = scale
+		families := gatherMetrics(t, newNvmeCollector(config))
+		if got, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); ok {
+			t.Errorf("nvme_temperature = %v in %s for a drive without a reading, want no value", got, scale)
+		}
+		if _, ok := families["nvme_temperature_sensor1"]; ok {
+			t.Errorf("nvme_temperature_sensor1 exported in %s for a drive without a reading", scale)
+		}
+		// the rest of the smart-log is still reported
+		if got, _ := metricValue(families, "nvme_avail_spare", "device", "/dev/nvme0n1"); got != 100 {
+			t.Errorf("nvme_avail_spare = %v, want 100", got)
+		}
+	}
+}
+
+func TestCompositeAsSensor0(t *testing.T) {
+	useTestSysfs(t)
+	runner := fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": `{"temperature": 318, "temperature_sensor_1": 300}`,
+	}
+	for _, scale := range []string{scaleCelsius, scaleFahrenheit, scaleKelvin} {
+		config := testCollectorConfig(runner)
+		config.temperatureScale = scale
+		config.compositeAsSensor0 = true
+		families := gatherMetrics(t, newNvmeCollector(config))
+		composite, ok := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1")
+		if !ok {
+			t.Fatalf("nvme_temperature is missing")
+		}
+		if got, ok := metricValue(families, "nvme_temperature_sensor0", "device", "/dev/nvme0n1"); !ok || got != composite {
+			t.Errorf("nvme_temperature_sensor0 = %v, %v in %s, want the composite %v", got, ok, scale, composite)
+		}
+	}
+	// off by default
+	families := gatherMetrics(t, newNvmeCollector(testCollectorConfig(runner)))
+	if _, ok := families["nvme_temperature_sensor0"]; ok {
+		t.Errorf("nvme_temperature_sensor0 exported without composite-as-sensor0")
+	}
+}
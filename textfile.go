@@ -0,0 +1,23 @@
+package main
+
+// Periodically write metrics to a file for the node_exporter textfile collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeTextfile writes everything gathered to path in the Prometheus text
+// format every interval. The metrics are written to a temporary file in the
+// same directory which is then renamed over path, so the textfile collector
+// never reads a partially written file.
+func writeTextfile(gatherer prometheus.Gatherer, path string, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		if err := prometheus.WriteToTextfile(path, gatherer); err != nil {
+			warnf("Error writing metrics to %s: %s\n", path, err)
+			continue
+		}
+		debugf("Wrote metrics to %s\n", path)
+	}
+}
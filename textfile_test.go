@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	useTestSysfs(t)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newNvmeCollector(testCollectorConfig(fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	})))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nvme.prom")
+	go writeTextfile(registry, path, time.Hour)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not written", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(file)
+	if err != nil {
+		t.Fatalf("error parsing %s: %s", path, err)
+	}
+	if got, _ := metricValue(families, "nvme_temperature", "device", "/dev/nvme0n1"); got != 36.85 {
+		t.Errorf("nvme_temperature = %v, want 36.85", got)
+	}
+	// the temporary file was renamed over the textfile
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("files left in the textfile directory: %v, want only nvme.prom", names)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+// Collect only when triggered with POST /collect
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// triggeredGatherer never collects on its own. Gather serves the result of
+// the last trigger, which is empty until the first trigger, so reading the
+// metrics never wakes the drives.
+type triggeredGatherer struct {
+	gatherer prometheus.Gatherer
+
+	mu             sync.Mutex
+	metricFamilies []*dto.MetricFamily
+	err            error
+}
+
+func newTriggeredGatherer(gatherer prometheus.Gatherer) *triggeredGatherer {
+	return &triggeredGatherer{gatherer: gatherer}
+}
+
+func (g *triggeredGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.metricFamilies, g.err
+}
+
+// trigger collects from the drives and caches the result until the next
+// trigger. Concurrent triggers wait for the collection in progress.
+func (g *triggeredGatherer) trigger() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.metricFamilies, g.err = g.gatherer.Gather()
+	return g.err
+}
+
+// collectHandler triggers a collection on POST
+func collectHandler(g *triggeredGatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed, use POST to trigger a collection", http.StatusMethodNotAllowed)
+			return
+		}
+		debugf("Collection triggered by %s\n", r.RemoteAddr)
+		if err := g.trigger(); err != nil {
+			http.Error(w, "Error gathering metrics: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
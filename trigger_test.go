@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingRunner counts the nvme commands run
+type countingRunner struct {
+	commandRunner
+	count int32
+}
+
+func (r *countingRunner) Run(name string, args ...string) ([]byte, error) {
+	atomic.AddInt32(&r.count, 1)
+	return r.commandRunner.Run(name, args...)
+}
+
+func TestTriggeredGatherer(t *testing.T) {
+	useTestSysfs(t)
+	runner := &countingRunner{commandRunner: fakeRunner{
+		"list":      testNvmeList,
+		"id-ctrl":   testIdCtrl,
+		"smart-log": testSmartLog,
+	}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newNvmeCollector(testCollectorConfig(runner)))
+	triggered := newTriggeredGatherer(registry)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(triggered))
+	mux.Handle("/collect", collectHandler(triggered))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	atomic.StoreInt32(&runner.count, 0)
+	if body := get(); strings.Contains(body, "nvme_temperature") {
+		t.Errorf("/metrics served drive metrics before the first trigger:\n%s", body)
+	}
+	if n := atomic.LoadInt32(&runner.count); n != 0 {
+		t.Errorf("GET /metrics ran %d nvme commands before the first trigger, want 0", n)
+	}
+
+	resp, err := http.Post(server.URL+"/collect", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST /collect = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	triggeredCount := atomic.LoadInt32(&runner.count)
+	if triggeredCount == 0 {
+		t.Fatalf("POST /collect ran no nvme commands")
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := get(); !strings.Contains(body, `nvme_temperature{device="/dev/nvme0n1"} 36.85`) {
+			t.Errorf("/metrics didn't serve the triggered collection:\n%s", body)
+		}
+	}
+	if n := atomic.LoadInt32(&runner.count); n != triggeredCount {
+		t.Errorf("GET /metrics ran %d nvme commands after the trigger, want 0", n-triggeredCount)
+	}
+
+	resp, err = http.Get(server.URL + "/collect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /collect = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+// Collect the smart-log of several devices concurrently
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type smartLogResult struct {
+	summary smartLogSummary
+	err     error
+}
+
+// collectSmartLogs collects the smart-log, OCP and persistent event log
+// metrics of namespaces with up to workers devices at a time. The results
+// are in the order of namespaces, the queue depth is the largest number of
+// devices that were waiting for a worker.
+func (c *nvmeCollector) collectSmartLogs(ch chan<- prometheus.Metric, namespaces []nvmeNamespace, idCtrls map[string]gjson.Result, workers int) ([]smartLogResult, int) {
+	results := make([]smartLogResult, len(namespaces))
+	jobs := make(chan int, len(namespaces))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = c.collectDevice(ch, namespaces[i], idCtrls[namespaces[i].Controller])
+			}
+		}()
+	}
+	queueDepth := 0
+	for i := range namespaces {
+		jobs <- i
+		if pending := len(jobs); pending > queueDepth {
+			queueDepth = pending
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results, queueDepth
+}
+
+// collectDevice collects the controller wide logs of a device, the other
+// logs are skipped when smart-log fails and its policy skips the device
+func (c *nvmeCollector) collectDevice(ch chan<- prometheus.Metric, namespace nvmeNamespace, idCtrl gjson.Result) smartLogResult {
+	var result smartLogResult
+	if c.adaptive != nil {
+		result.summary, result.err = c.adaptive.collect(ch, namespace.DevicePath, c.smartLogLabel(namespace), func(ch chan<- prometheus.Metric) (smartLogSummary, error) {
+			return c.collectSmartLog(ch, namespace, idCtrl)
+		})
+	} else {
+		result.summary, result.err = c.collectSmartLog(ch, namespace, idCtrl)
+	}
+	if result.err != nil && policyFor("smart-log").SkipDevice {
+		return result
+	}
+	if c.ocp != nil {
+		c.ocp.collect(ch, namespace.DevicePath)
+	}
+	if c.persistentEventLog != nil {
+		c.persistentEventLog.collect(ch, namespace.DevicePath)
+	}
+	return result
+}